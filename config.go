@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/simonleung8/flags"
+	"gopkg.in/yaml.v2"
+)
+
+// nozzleConfig is the content of the config file: named profiles, each
+// setting flags by their long name.
+//
+//	profiles:
+//	  errors:
+//	    filter: Error
+//	    subscription-id: errors
+//	    dedupe: 10s
+type nozzleConfig struct {
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// configDir returns the directory of the config of the cf CLI, where the
+// plugin keeps its own files.
+func configDir() string {
+	home := os.Getenv("CF_HOME")
+	if home == "" {
+		home = os.Getenv("HOME")
+	}
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".cf")
+}
+
+// configPath returns the path of the config file.
+func configPath() string {
+	return filepath.Join(configDir(), "nozzle.yml")
+}
+
+// selectionPath returns the path of the file remembering the last filter
+// picked interactively for each command.
+func selectionPath() string {
+	return filepath.Join(configDir(), "nozzle-selections.json")
+}
+
+// loadProfile reads a profile of the config file into the flags of the
+// nozzle commands.
+func loadProfile(path, name string) (flags.FlagContext, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file %s: %s", path, err)
+	}
+
+	var config nozzleConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s: %s", path, err)
+	}
+
+	options, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Profile %s not found in %s", name, path)
+	}
+
+	names := make([]string, 0, len(options))
+	for option := range options {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, option := range names {
+		if option == "profile" {
+			return nil, fmt.Errorf("Invalid profile %s: profiles cannot include other profiles", name)
+		}
+		switch value := options[option].(type) {
+		case bool:
+			if value {
+				args = append(args, "--"+option)
+			}
+		case []interface{}:
+			values := make([]string, len(value))
+			for i, v := range value {
+				values[i] = fmt.Sprint(v)
+			}
+			args = append(args, fmt.Sprintf("--%s=%s", option, strings.Join(values, ",")))
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", option, value))
+		}
+	}
+
+	profile := newClientFlags()
+	if err := profile.Parse(args...); err != nil {
+		return nil, fmt.Errorf("Invalid profile %s: %s", name, err)
+	}
+	return profile, nil
+}
+
+// profileFlags reads the flags given on the command line, falling back to
+// the ones set by a profile.
+type profileFlags struct {
+	flags.FlagContext
+	profile flags.FlagContext
+}
+
+// profileFlagGroups lists the flags that make up a single setting. Setting
+// any of them on the command line overrides all of them in the profile.
+var profileFlagGroups = [][]string{
+	{"filter", "no-filter"},
+}
+
+// source returns where the value of the flag comes from.
+func (p profileFlags) source(name string) flags.FlagContext {
+	if p.FlagContext.IsSet(name) {
+		return p.FlagContext
+	}
+	for _, group := range profileFlagGroups {
+		if !containsString(group, name) {
+			continue
+		}
+		for _, other := range group {
+			if p.FlagContext.IsSet(other) {
+				return p.FlagContext
+			}
+		}
+	}
+	return p.profile
+}
+
+func (p profileFlags) IsSet(name string) bool {
+	return p.source(name).IsSet(name)
+}
+
+func (p profileFlags) String(name string) string {
+	return p.source(name).String(name)
+}
+
+func (p profileFlags) Int(name string) int {
+	return p.source(name).Int(name)
+}
+
+func (p profileFlags) Bool(name string) bool {
+	return p.source(name).Bool(name)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("loadProfile", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nozzle-config")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "nozzle.yml")
+		Expect(ioutil.WriteFile(path, []byte(`
+profiles:
+  storms:
+    no-filter: true
+    dedupe-normalize: false
+    sample-per-key: [origin, job]
+    sample-reservoir: 5
+    subscription-id: storms
+  typo:
+    filtr: Error
+  nested:
+    profile: storms
+`), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads the options of the profile as flags", func() {
+		profile, err := loadProfile(path, "storms")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profile.Bool("no-filter")).To(BeTrue())
+		Expect(profile.IsSet("dedupe-normalize")).To(BeFalse())
+		Expect(profile.String("sample-per-key")).To(Equal("origin,job"))
+		Expect(profile.Int("sample-reservoir")).To(Equal(5))
+		Expect(profile.String("subscription-id")).To(Equal("storms"))
+	})
+
+	It("lets the command line override the profile", func() {
+		profile, err := loadProfile(path, "storms")
+		Expect(err).NotTo(HaveOccurred())
+		commandLine := newClientFlags()
+		Expect(commandLine.Parse("--sample-reservoir", "2")).To(Succeed())
+
+		fc := profileFlags{FlagContext: commandLine, profile: profile}
+		Expect(fc.Int("sample-reservoir")).To(Equal(2))
+		Expect(fc.String("subscription-id")).To(Equal("storms"))
+		Expect(fc.IsSet("filter")).To(BeFalse())
+	})
+
+	It("lets a filter on the command line override the filter settings of the profile", func() {
+		profile, err := loadProfile(path, "storms")
+		Expect(err).NotTo(HaveOccurred())
+		commandLine := newClientFlags()
+		Expect(commandLine.Parse("--filter", "LogMessage")).To(Succeed())
+
+		fc := profileFlags{FlagContext: commandLine, profile: profile}
+		Expect(fc.String("filter")).To(Equal("LogMessage"))
+		Expect(fc.IsSet("no-filter")).To(BeFalse())
+		Expect(fc.Bool("no-filter")).To(BeFalse())
+	})
+
+	It("fails for an unknown profile", func() {
+		_, err := loadProfile(path, "missing")
+		Expect(err).To(MatchError("Profile missing not found in " + path))
+	})
+
+	It("fails for an unknown option", func() {
+		_, err := loadProfile(path, "typo")
+		Expect(err).To(MatchError(ContainSubstring("Invalid profile typo:")))
+	})
+
+	It("fails for a profile including another one", func() {
+		_, err := loadProfile(path, "nested")
+		Expect(err).To(MatchError("Invalid profile nested: profiles cannot include other profiles"))
+	})
+
+	It("fails for a missing config file", func() {
+		_, err := loadProfile(filepath.Join(dir, "missing.yml"), "storms")
+		Expect(err).To(MatchError(ContainSubstring("Unable to read config file")))
+	})
+})
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals make a running nozzle dump its ring buffer.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// dumpSignals is empty on Windows, which has no SIGUSR1.
+var dumpSignals []os.Signal
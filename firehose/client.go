@@ -1,29 +1,135 @@
 package firehose
 
 import (
+	"context"
 	"crypto/tls"
-	"strconv"
+	"errors"
+	"sync"
+	"time"
 
 	"fmt"
 
 	"github.com/cloudfoundry/cli/cf/terminal"
-	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+// ErrStopped is returned by Start when the session was stopped with Stop
+// or Interrupt.
+var ErrStopped = errors.New("The nozzle was stopped")
+
+// ErrConnectionClosed is returned by Start when the connection closed
+// without an error.
+var ErrConnectionClosed = errors.New("The connection to doppler closed")
+
+// ErrNonInteractive is returned instead of prompting when the client runs
+// in non-interactive mode.
+var ErrNonInteractive = errors.New("No filter given and unable to prompt for one in non-interactive mode. " +
+	"Use --filter, --no-filter or --default-filter")
+
 type Client struct {
 	dopplerEndpoint string
 	authToken       string
 	options         *ClientOptions
 	ui              terminal.UI
+
+	sinks []Sink
+
+	// lock guards the state of the running session, which Stop,
+	// Interrupt and DumpRing use from other goroutines.
+	lock             sync.Mutex
+	cancel           context.CancelFunc
+	finished         chan struct{}
+	stopped          bool
+	stopRequested    bool
+	streaming        bool
+	dump             chan struct{}
+	stopConditionMet bool
 }
 
 type ClientOptions struct {
-	AppGUID        string
-	Debug          bool
-	NoFilter       bool
-	Filter         string
-	SubscriptionID string
+	AppGUID           string
+	Debug             bool
+	NoFilter          bool
+	Filter            string
+	DefaultFilter     string
+	SelectionFile     string
+	SelectionKey      string
+	NonInteractive    bool
+	SubscriptionID    string
+	Prometheus        string
+	Output            string
+	OutputAddress     string
+	Statsd            string
+	StatsdTemplate    string
+	StatsdSanitize    string
+	Syslog            string
+	ServeSSE          string
+	OutputFile        string
+	OutputFileMaxSize string
+	OutputFileRotate  time.Duration
+	OutputFileKeep    int
+	Store             string
+	Ring              int
+	RingTrigger       string
+	RingDir           string
+	Trace             string
+	Duration          time.Duration
+	Count             int
+	Until             string
+	Connections       int
+	BufferSize        int
+	BufferPolicy      string
+	Sample            string
+	SamplePerKey      string
+	SampleReservoir   int
+	MaxRate           string
+	Dedupe            time.Duration
+	DedupeNormalize   bool
+	Stitch            time.Duration
+	NoDisplay         bool
+}
+
+// PromptsForFilter reports whether the client has to ask for the type of
+// messages to display.
+func (o *ClientOptions) PromptsForFilter() bool {
+	return !o.NoFilter && o.Filter == ""
+}
+
+// HasStopCondition reports whether the session should end on its own
+// rather than only when the connection closes.
+func (o *ClientOptions) HasStopCondition() bool {
+	return o.Duration > 0 || o.Count > 0 || o.Until != ""
+}
+
+// WritesMetricsToStdout reports whether the --output metrics go to stdout,
+// which the UI should then leave to them.
+func (o *ClientOptions) WritesMetricsToStdout() bool {
+	return o.Output != "" && o.OutputAddress == ""
+}
+
+// nozzle returns the Nozzle streaming the envelopes the options select,
+// with further options applied on top.
+func (c *Client) nozzle(options ...Option) *Nozzle {
+	defaults := []Option{
+		WithToken(c.authToken),
+		WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+		WithSubscriptionID(c.subscriptionID()),
+		WithConnections(c.options.Connections),
+	}
+	if len(c.options.AppGUID) != 0 {
+		defaults = append(defaults, WithAppGUID(c.options.AppGUID))
+	}
+	if c.options.Debug {
+		defaults = append(defaults, WithDebugPrinter(ConsoleDebugPrinter{ui: c.ui}))
+	}
+	return NewNozzle(c.dopplerEndpoint, append(defaults, options...)...)
+}
+
+func (c *Client) subscriptionID() string {
+	if len(c.options.SubscriptionID) == 0 {
+		return defaultSubscriptionID
+	}
+	return c.options.SubscriptionID
 }
 
 func NewClient(authToken, doppplerEndpoint string, options *ClientOptions, ui terminal.UI) *Client {
@@ -36,97 +142,448 @@ func NewClient(authToken, doppplerEndpoint string, options *ClientOptions, ui te
 
 }
 
-func (c *Client) Start() {
-	var err error
-	dopplerConnection := consumer.New(c.dopplerEndpoint, &tls.Config{InsecureSkipVerify: true}, nil)
-	if c.options.Debug {
-		dopplerConnection.SetDebugPrinter(ConsoleDebugPrinter{ui: c.ui})
+// Start runs a session until the connection closes, a stop condition is
+// met, the session is stopped or the context is done. It returns nil when a
+// stop condition ended the session, ErrStopped when it was stopped, the
+// error of the context when it is done, and otherwise the error that ended
+// the stream or ErrConnectionClosed.
+func (c *Client) Start(ctx context.Context) error {
+	ctx, err := c.begin(ctx)
+	if err != nil {
+		return err
 	}
-	filter := ""
+	var conditionMet bool
+	defer func() {
+		c.end(conditionMet)
+	}()
+
+	var filter *envelopeFilter
 	switch {
 	case c.options.NoFilter:
-		filter = ""
+		filter = newEnvelopeFilter()
 	case c.options.Filter != "":
-		envelopeType, ok := events.Envelope_EventType_value[c.options.Filter]
-		if !ok {
-			c.ui.Warn("Unable to recognize filter %s", c.options.Filter)
-			return
+		filter, err = parseFilter(c.options.Filter)
+		if err != nil {
+			c.ui.Warn(err.Error())
+			return err
+		}
+
+	case c.options.NonInteractive:
+		filter, err = c.defaultFilter()
+		if err != nil {
+			c.ui.Warn(err.Error())
+			return err
 		}
-		filter = strconv.Itoa(int(envelopeType))
 
 	default:
 		c.ui.Say("What type of firehose messages do you want to see?")
-		filter, err = c.promptFilterType()
-		if err != nil {
+		filter, err = c.pickFilter(ctx)
+		if err != nil && ctx.Err() == nil {
 			c.ui.Warn(err.Error())
-			return
+			return err
 		}
 	}
+	if ctx.Err() != nil {
+		reason, err := c.stopReason(ctx)
+		c.ui.Say("Stopping the nozzle: %s", reason)
+		return err
+	}
+
+	connections := c.options.Connections
+	if connections < 1 {
+		connections = 1
+	}
+	if len(c.options.AppGUID) != 0 && connections > 1 {
+		c.ui.Warn(ErrAppConnections.Error())
+		return ErrAppConnections
+	}
+
+	session, err := newSession(c.options, filter)
+	if err != nil {
+		c.ui.Warn(err.Error())
+		return err
+	}
+
+	session.sinks, err = c.openSinks()
+	if err != nil {
+		c.ui.Warn(err.Error())
+		return err
+	}
 
-	var errors <-chan error
-	var output <-chan *events.Envelope
 	if len(c.options.AppGUID) != 0 {
 		c.ui.Say("Starting the nozzle for app %s", c.options.AppGUID)
-		output, errors = dopplerConnection.StreamWithoutReconnect(c.options.AppGUID, c.authToken)
+	} else if connections > 1 {
+		c.ui.Say("Starting the nozzle with %d connections", connections)
 	} else {
-		subscriptionID := c.options.SubscriptionID
-		if len(subscriptionID) == 0 {
-			subscriptionID = "FirehosePlugin"
-		}
 		c.ui.Say("Starting the nozzle")
-		output, errors = dopplerConnection.FirehoseWithoutReconnect(subscriptionID, c.authToken)
 	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	output, errors := c.nozzle().Stream(streamCtx)
 
+	summary := session.summary
+	var streamErr error
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		for err := range errors {
+			streamErr = err
+			summary.errorSeen()
 			c.ui.Warn(err.Error())
-			return
+			if slowConsumer, ok := err.(*SlowConsumerError); ok {
+				c.warnSlowConsumer(slowConsumer.Alert, session)
+			}
 		}
 	}()
 
-	defer dopplerConnection.Close()
+	go c.receive(output, session)
+	buffered := session.buffer.channel()
+
+	dump := c.startStreaming()
+	defer c.stopStreaming()
 
+	if session.tracer.enabled() {
+		c.ui.Say("Tracing request %s", session.tracer.requestID)
+	}
+	if session.stitcher.enabled() {
+		c.ui.Say("Stitching HttpStart and HttpStop events within %s", session.stitcher.timeout)
+	}
+	if session.sampler.enabled() {
+		c.ui.Say("Sampling %s", session.sampler.description())
+	}
+	if session.limiter.enabled() {
+		c.ui.Say("Displaying at most %s messages", session.limiter.description())
+	}
+	if session.ring.enabled() {
+		c.ui.Say("Keeping the last %d messages to dump into %s", len(session.ring.envelopes), session.ring.dir)
+	}
 	c.ui.Say("Hit Ctrl+c to exit")
 
-	for envelope := range output {
-		if filter == "" || filter == strconv.Itoa((int)(envelope.GetEventType())) {
-			c.ui.Say("%v \n", envelope)
+	var timeout <-chan time.Time
+	if c.options.Duration > 0 {
+		timer := time.NewTimer(c.options.Duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var samplingWindowEnd <-chan time.Time
+	if session.sampler.perKey() {
+		ticker := time.NewTicker(samplingWindow)
+		defer ticker.Stop()
+		samplingWindowEnd = ticker.C
+	}
+
+	var dedupeWindowEnd <-chan time.Time
+	if session.deduper.enabled() {
+		ticker := time.NewTicker(session.deduper.window)
+		defer ticker.Stop()
+		dedupeWindowEnd = ticker.C
+	}
+
+	var stitchTimeout <-chan time.Time
+	if session.stitcher.enabled() {
+		ticker := time.NewTicker(session.stitcher.timeout)
+		defer ticker.Stop()
+		stitchTimeout = ticker.C
+	}
+
+	var suppressionReport <-chan time.Time
+	if session.limiter.enabled() {
+		ticker := time.NewTicker(suppressionReportInterval)
+		defer ticker.Stop()
+		suppressionReport = ticker.C
+	}
+
+	var stopReason string
+	var result error
+	var closed bool
+stream:
+	for {
+		select {
+		case envelope, ok := <-buffered:
+			if !ok {
+				closed = true
+				stopReason, conditionMet = c.display(session.sampler.flush(), session)
+				break stream
+			}
+			if !session.filtered(envelope) {
+				continue
+			}
+			if joined, ok := session.stitcher.stitch(envelope); ok {
+				if joined == nil {
+					continue
+				}
+				envelope = joined
+			}
+			if session.deduper.suppress(envelope) {
+				continue
+			}
+			if stopReason, conditionMet = c.display(session.sampler.sample(envelope), session); conditionMet {
+				break stream
+			}
+		case <-samplingWindowEnd:
+			if stopReason, conditionMet = c.display(session.sampler.flush(), session); conditionMet {
+				break stream
+			}
+		case <-dedupeWindowEnd:
+			for _, line := range session.deduper.flush() {
+				c.ui.Say(line)
+			}
+		case <-stitchTimeout:
+			for _, line := range session.stitcher.expire() {
+				c.ui.Warn(line)
+			}
+		case <-suppressionReport:
+			if report, ok := session.limiter.report(); ok {
+				c.ui.Say(report)
+			}
+		case <-dump:
+			c.dumpRing(session, "requested")
+		case <-timeout:
+			c.display(session.sampler.flush(), session)
+			stopReason = fmt.Sprintf("reached duration of %s", c.options.Duration)
+			conditionMet = true
+			break stream
+		case <-ctx.Done():
+			c.display(session.sampler.flush(), session)
+			stopReason, result = c.stopReason(ctx)
+			break stream
 		}
 	}
+
+	if stopReason != "" {
+		c.ui.Say("Stopping the nozzle: %s", stopReason)
+	}
+
+	// Once the connections closed on their own, their last errors may still
+	// be on the way and cancelling would drop them.
+	if !closed {
+		cancel()
+	}
+	for range buffered {
+	}
 	<-done
+	if stopReason == "" {
+		result = streamErr
+		if result == nil {
+			result = ErrConnectionClosed
+		}
+	}
+
+	for _, line := range session.deduper.flush() {
+		c.ui.Say(line)
+	}
+	for _, line := range session.stitcher.flush() {
+		c.ui.Warn(line)
+	}
+	if report, ok := session.limiter.report(); ok {
+		c.ui.Say(report)
+	}
+	c.closeSinks(session)
+	session.finish()
+	summary.print(c.ui)
+	return result
 }
 
-func (c *Client) promptFilterType() (string, error) {
+// display prints the envelopes the rate limit allows and returns the stop
+// condition reached, if any.
+func (c *Client) display(envelopes []*events.Envelope, session *session) (string, bool) {
+	for _, envelope := range envelopes {
+		if !session.limiter.allow(envelope) {
+			continue
+		}
+		if !c.options.NoDisplay {
+			if record, ok := session.stitcher.describe(envelope); ok {
+				c.ui.Say(record)
+			} else {
+				c.ui.Say("%v \n", envelope)
+			}
+		}
+		c.writeToSinks(envelope, session)
+		session.summary.envelopeDisplayed(envelope)
+		if session.ring.triggered(envelope) {
+			c.dumpRing(session, fmt.Sprintf("found a message matching %s", session.ring.trigger.String()))
+		}
+		if reason, ok := session.conditions.reached(envelope); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
 
-	filter := c.ui.Ask(`Please enter one of the following choices:
-	  hit 'enter' for all messages
-	  2 for HttpStart
-	  3 for HttpStop
-	  4 for HttpStartStop
-	  5 for LogMessage
-	  6 for ValueMetric
-	  7 for CounterEvent
-	  8 for Error
-	  9 for ContainerMetric
-	`)
+// receive keeps reading from the connection at full speed, handing the
+// envelopes over to the buffer.
+func (c *Client) receive(output <-chan *events.Envelope, session *session) {
+	defer session.buffer.close()
+	for envelope := range output {
+		session.summary.envelopeReceived(envelope)
+		session.ring.push(envelope)
+		if alert, ok := slowConsumerAlert(envelope); ok {
+			c.warnSlowConsumer(alert, session)
+		}
+		session.buffer.push(envelope)
+	}
+}
 
-	if filter == "" {
-		return "", nil
+func (c *Client) warnSlowConsumer(alert string, session *session) {
+	c.ui.Warn("Slow consumer: %s", alert)
+	if session.summary.slowConsumerAlertSeen() {
+		c.ui.Warn(slowConsumerHint)
+		c.dumpRing(session, "slow consumer alert")
 	}
+}
 
-	filterInt, err := strconv.Atoi(filter)
+// dumpRing writes the ring buffer, if there is one, to a file.
+func (c *Client) dumpRing(session *session, reason string) {
+	if !session.ring.enabled() {
+		return
+	}
+	path, count, err := session.ring.dump()
 	if err != nil {
-		return "", fmt.Errorf("Invalid filter choice %s. Enter an index from 2-9", filter)
+		session.summary.errorSeen()
+		c.ui.Warn(err.Error())
+		return
 	}
+	c.ui.Say("Dumped the last %d messages to %s: %s", count, path, reason)
+}
 
-	_, ok := events.Envelope_EventType_name[int32(filterInt)]
-	if !ok {
-		return "", fmt.Errorf("Invalid filter choice %d", filterInt)
+// Interrupt ends a running session as if its connection had closed. It
+// returns false if there is no session to end, either because streaming
+// has not started yet or because it was already interrupted.
+func (c *Client) Interrupt() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.streaming || c.stopRequested {
+		return false
 	}
+	c.stopRequested = true
+	c.cancel()
+	return true
+}
 
-	return filter, nil
+// DumpRing asks a running session to dump its ring buffer to a file. It
+// returns false if there is no session or it keeps no ring buffer.
+func (c *Client) DumpRing() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dump == nil || c.options.Ring < 1 {
+		return false
+	}
+	select {
+	case c.dump <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Stop ends the running session, even while it prompts for a filter or
+// samples the stream, and waits until Start has closed the connection,
+// drained what it received and returned. A stopped client stays stopped:
+// every later call to Start returns ErrStopped right away, including one
+// that was about to begin when Stop was called.
+func (c *Client) Stop() {
+	c.lock.Lock()
+	c.stopped = true
+	if c.cancel == nil {
+		c.lock.Unlock()
+		return
+	}
+	if !c.stopRequested {
+		c.stopRequested = true
+		c.cancel()
+	}
+	finished := c.finished
+	c.lock.Unlock()
+	<-finished
+}
+
+// begin registers a running session, unless the client was stopped, and
+// returns the context that ending it cancels.
+func (c *Client) begin(parent context.Context) (context.Context, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopped {
+		return nil, ErrStopped
+	}
+	ctx, cancel := context.WithCancel(parent)
+	c.cancel = cancel
+	c.finished = make(chan struct{})
+	c.stopConditionMet = false
+	return ctx, nil
+}
+
+func (c *Client) end(conditionMet bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cancel()
+	c.cancel = nil
+	close(c.finished)
+	c.finished = nil
+	c.stopRequested = false
+	c.stopConditionMet = conditionMet
+}
+
+// stopReason describes why the context of the session is done.
+func (c *Client) stopReason(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopRequested {
+		return "interrupted", ErrStopped
+	}
+	return ctx.Err().Error(), ctx.Err()
+}
+
+func (c *Client) startStreaming() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.streaming = true
+	c.dump = make(chan struct{}, 1)
+	return c.dump
+}
+
+func (c *Client) stopStreaming() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.streaming = false
+	c.dump = nil
+}
+
+// StopConditionMet reports whether the last session ended because one of
+// the configured stop conditions was satisfied.
+func (c *Client) StopConditionMet() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stopConditionMet
+}
+
+// ask prompts the user, unless the client runs in non-interactive mode, and
+// gives up when the context is done. The UI cannot cancel a prompt, so an
+// abandoned one still takes the next line of input.
+func (c *Client) ask(ctx context.Context, prompt string) (string, error) {
+	if c.options.NonInteractive {
+		return "", ErrNonInteractive
+	}
+	answer := make(chan string, 1)
+	go func() {
+		answer <- c.ui.Ask(prompt)
+	}()
+	select {
+	case a := <-answer:
+		return a, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// defaultFilter stands in for the prompt in non-interactive mode.
+func (c *Client) defaultFilter() (*envelopeFilter, error) {
+	switch c.options.DefaultFilter {
+	case "":
+		return nil, ErrNonInteractive
+	case "all":
+		return newEnvelopeFilter(), nil
+	}
+	return parseFilter(c.options.DefaultFilter)
 }
 
 type ConsoleDebugPrinter struct {
@@ -0,0 +1,111 @@
+package firehose
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var numericToken = regexp.MustCompile(`\d+`)
+
+// deduper collapses identical log messages and errors seen within a window
+// into the first occurrence plus a repeat count at the end of the window.
+type deduper struct {
+	window    time.Duration
+	normalize bool
+
+	duplicates map[string]*duplicate
+	order      []string
+	collapsed  int
+}
+
+type duplicate struct {
+	description string
+	repeats     int
+}
+
+func newDeduper(window time.Duration, normalize bool) *deduper {
+	return &deduper{
+		window:     window,
+		normalize:  normalize,
+		duplicates: make(map[string]*duplicate),
+	}
+}
+
+func (d *deduper) enabled() bool {
+	return d.window > 0
+}
+
+// suppress reports whether the envelope repeats one already displayed in
+// the current window.
+func (d *deduper) suppress(envelope *events.Envelope) bool {
+	if !d.enabled() {
+		return false
+	}
+
+	key, description, ok := d.key(envelope)
+	if !ok {
+		return false
+	}
+
+	if dup, ok := d.duplicates[key]; ok {
+		dup.repeats++
+		d.collapsed++
+		return true
+	}
+	d.duplicates[key] = &duplicate{description: description}
+	d.order = append(d.order, key)
+	return false
+}
+
+// flush ends the window, returning a line for every message that was
+// repeated in it.
+func (d *deduper) flush() []string {
+	var lines []string
+	for _, key := range d.order {
+		dup := d.duplicates[key]
+		if dup.repeats > 0 {
+			lines = append(lines, fmt.Sprintf("... repeated %s more times in last %s: %s", formatCount(dup.repeats), d.window, dup.description))
+		}
+	}
+	d.duplicates = make(map[string]*duplicate)
+	d.order = nil
+	return lines
+}
+
+func (d *deduper) key(envelope *events.Envelope) (string, string, bool) {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		logMessage := envelope.GetLogMessage()
+		source := logMessage.GetSourceType()
+		if logMessage.GetSourceInstance() != "" {
+			source += "/" + logMessage.GetSourceInstance()
+		}
+		message := d.normalized(string(logMessage.GetMessage()))
+		description := "LogMessage"
+		if logMessage.GetAppId() != "" {
+			description += " from app " + logMessage.GetAppId()
+		}
+		if source != "" {
+			description += " [" + source + "]"
+		}
+		description += ": " + message
+		return strings.Join([]string{"LogMessage", logMessage.GetAppId(), source, message}, "\x00"), description, true
+	case events.Envelope_Error:
+		logError := envelope.GetError()
+		message := d.normalized(logError.GetMessage())
+		description := fmt.Sprintf("Error from %s: %s", logError.GetSource(), message)
+		return strings.Join([]string{"Error", logError.GetSource(), message}, "\x00"), description, true
+	}
+	return "", "", false
+}
+
+func (d *deduper) normalized(message string) string {
+	if !d.normalize {
+		return message
+	}
+	return numericToken.ReplaceAllString(message, "#")
+}
@@ -0,0 +1,75 @@
+package firehose
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("deduper", func() {
+	logMessage := func(appID, message string) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:        []byte(message),
+				AppId:          proto.String(appID),
+				SourceType:     proto.String("APP/PROC/WEB"),
+				SourceInstance: proto.String("0"),
+			},
+		}
+	}
+
+	errorMessage := func(source, message string) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_Error.Enum(),
+			Error:     &events.Error{Source: proto.String(source), Message: proto.String(message)},
+		}
+	}
+
+	It("lets everything through when disabled", func() {
+		d := newDeduper(0, false)
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeFalse())
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeFalse())
+	})
+
+	It("collapses identical messages per app and source until the window ends", func() {
+		d := newDeduper(10*time.Second, false)
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeFalse())
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeTrue())
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeTrue())
+		Expect(d.suppress(logMessage("other-app", "crash"))).To(BeFalse())
+		Expect(d.suppress(errorMessage("router", "timeout"))).To(BeFalse())
+		Expect(d.suppress(errorMessage("router", "timeout"))).To(BeTrue())
+
+		Expect(d.flush()).To(Equal([]string{
+			"... repeated 2 more times in last 10s: LogMessage from app app [APP/PROC/WEB/0]: crash",
+			"... repeated 1 more times in last 10s: Error from router: timeout",
+		}))
+		Expect(d.collapsed).To(Equal(3))
+
+		Expect(d.suppress(logMessage("app", "crash"))).To(BeFalse())
+	})
+
+	It("does not collapse other event types", func() {
+		d := newDeduper(10*time.Second, false)
+		metric := &events.Envelope{EventType: events.Envelope_ValueMetric.Enum()}
+		Expect(d.suppress(metric)).To(BeFalse())
+		Expect(d.suppress(metric)).To(BeFalse())
+	})
+
+	It("optionally ignores numbers", func() {
+		strict := newDeduper(10*time.Second, false)
+		Expect(strict.suppress(logMessage("app", "took 12ms"))).To(BeFalse())
+		Expect(strict.suppress(logMessage("app", "took 345ms"))).To(BeFalse())
+
+		normalized := newDeduper(10*time.Second, true)
+		Expect(normalized.suppress(logMessage("app", "took 12ms"))).To(BeFalse())
+		Expect(normalized.suppress(logMessage("app", "took 345ms"))).To(BeTrue())
+		Expect(normalized.flush()).To(Equal([]string{
+			"... repeated 1 more times in last 10s: LogMessage from app app [APP/PROC/WEB/0]: took #ms",
+		}))
+	})
+})
@@ -0,0 +1,141 @@
+package firehose
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	bufferPolicyBlock      = "block"
+	bufferPolicyDropOldest = "drop-oldest"
+	bufferPolicyDropNewest = "drop-newest"
+	bufferPolicySample     = "sample"
+
+	defaultBufferSize = 1000
+
+	// bufferSampleRate is how many envelopes arriving at a full buffer it
+	// takes for one of them to replace the oldest buffered envelope.
+	bufferSampleRate = 10
+)
+
+// envelopeBuffer is a bounded queue between the websocket reader and the
+// output. Unless its policy is to block, a full buffer drops envelopes
+// instead of slowing down the reader.
+type envelopeBuffer struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	policy    string
+	envelopes []*events.Envelope
+	head      int
+	count     int
+	closed    bool
+
+	overflow int
+	dropped  int
+}
+
+func newEnvelopeBuffer(size int, policy string) (*envelopeBuffer, error) {
+	if size < 1 {
+		size = defaultBufferSize
+	}
+	switch policy {
+	case "":
+		policy = bufferPolicyBlock
+	case bufferPolicyBlock, bufferPolicyDropOldest, bufferPolicyDropNewest, bufferPolicySample:
+	default:
+		return nil, fmt.Errorf("Unable to recognize buffer policy %s", policy)
+	}
+
+	b := &envelopeBuffer{
+		policy:    policy,
+		envelopes: make([]*events.Envelope, size),
+	}
+	b.notEmpty = sync.NewCond(&b.lock)
+	b.notFull = sync.NewCond(&b.lock)
+	return b, nil
+}
+
+func (b *envelopeBuffer) push(envelope *events.Envelope) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.policy == bufferPolicyBlock && b.count == len(b.envelopes) {
+		b.notFull.Wait()
+	}
+
+	if b.count == len(b.envelopes) {
+		switch b.policy {
+		case bufferPolicyDropNewest:
+			b.dropped++
+			return
+		case bufferPolicySample:
+			b.overflow++
+			if b.overflow%bufferSampleRate != 0 {
+				b.dropped++
+				return
+			}
+		}
+		b.head = (b.head + 1) % len(b.envelopes)
+		b.count--
+		b.dropped++
+	}
+
+	b.envelopes[(b.head+b.count)%len(b.envelopes)] = envelope
+	b.count++
+	b.notEmpty.Signal()
+}
+
+// pop blocks until an envelope is available. It returns false once the
+// buffer is closed and empty.
+func (b *envelopeBuffer) pop() (*events.Envelope, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.count == 0 && !b.closed {
+		b.notEmpty.Wait()
+	}
+	if b.count == 0 {
+		return nil, false
+	}
+
+	envelope := b.envelopes[b.head]
+	b.envelopes[b.head] = nil
+	b.head = (b.head + 1) % len(b.envelopes)
+	b.count--
+	b.notFull.Signal()
+	return envelope, true
+}
+
+func (b *envelopeBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.notEmpty.Broadcast()
+}
+
+func (b *envelopeBuffer) droppedCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+// channel streams the buffered envelopes until the buffer is closed and
+// drained.
+func (b *envelopeBuffer) channel() <-chan *events.Envelope {
+	output := make(chan *events.Envelope)
+	go func() {
+		defer close(output)
+		for {
+			envelope, ok := b.pop()
+			if !ok {
+				return
+			}
+			output <- envelope
+		}
+	}()
+	return output
+}
@@ -0,0 +1,97 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("envelopeBuffer", func() {
+	envelope := func(origin string) *events.Envelope {
+		return &events.Envelope{Origin: proto.String(origin), EventType: events.Envelope_LogMessage.Enum()}
+	}
+
+	drain := func(buffer *envelopeBuffer) []string {
+		buffer.close()
+		var origins []string
+		for {
+			envelope, ok := buffer.pop()
+			if !ok {
+				return origins
+			}
+			origins = append(origins, envelope.GetOrigin())
+		}
+	}
+
+	It("rejects unknown policies", func() {
+		_, err := newEnvelopeBuffer(1, "drop-everything")
+		Expect(err).To(MatchError("Unable to recognize buffer policy drop-everything"))
+	})
+
+	It("defaults to a blocking buffer", func() {
+		buffer, err := newEnvelopeBuffer(0, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buffer.policy).To(Equal(bufferPolicyBlock))
+		Expect(buffer.envelopes).To(HaveLen(defaultBufferSize))
+	})
+
+	It("blocks the writer until there is room", func() {
+		buffer, _ := newEnvelopeBuffer(1, bufferPolicyBlock)
+		buffer.push(envelope("first"))
+
+		pushed := make(chan struct{})
+		go func() {
+			buffer.push(envelope("second"))
+			close(pushed)
+		}()
+		Consistently(pushed).ShouldNot(BeClosed())
+
+		first, _ := buffer.pop()
+		Expect(first.GetOrigin()).To(Equal("first"))
+		Eventually(pushed).Should(BeClosed())
+		Expect(drain(buffer)).To(Equal([]string{"second"}))
+		Expect(buffer.droppedCount()).To(Equal(0))
+	})
+
+	It("drops the oldest envelopes", func() {
+		buffer, _ := newEnvelopeBuffer(2, bufferPolicyDropOldest)
+		for _, origin := range []string{"a", "b", "c", "d"} {
+			buffer.push(envelope(origin))
+		}
+		Expect(drain(buffer)).To(Equal([]string{"c", "d"}))
+		Expect(buffer.droppedCount()).To(Equal(2))
+	})
+
+	It("drops the newest envelopes", func() {
+		buffer, _ := newEnvelopeBuffer(2, bufferPolicyDropNewest)
+		for _, origin := range []string{"a", "b", "c", "d"} {
+			buffer.push(envelope(origin))
+		}
+		Expect(drain(buffer)).To(Equal([]string{"a", "b"}))
+		Expect(buffer.droppedCount()).To(Equal(2))
+	})
+
+	It("samples the envelopes arriving at a full buffer", func() {
+		buffer, _ := newEnvelopeBuffer(1, bufferPolicySample)
+		buffer.push(envelope("first"))
+		for i := 0; i < bufferSampleRate; i++ {
+			buffer.push(envelope("overflow"))
+		}
+		Expect(drain(buffer)).To(Equal([]string{"overflow"}))
+		Expect(buffer.droppedCount()).To(Equal(bufferSampleRate))
+	})
+
+	It("streams envelopes until closed", func() {
+		buffer, _ := newEnvelopeBuffer(3, bufferPolicyBlock)
+		buffer.push(envelope("a"))
+		buffer.push(envelope("b"))
+		buffer.close()
+
+		var origins []string
+		for envelope := range buffer.channel() {
+			origins = append(origins, envelope.GetOrigin())
+		}
+		Expect(origins).To(Equal([]string{"a", "b"}))
+	})
+})
@@ -0,0 +1,120 @@
+package firehose
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// envelopeFilter selects the envelopes to display by event type and,
+// optionally, by origin and job. An empty set selects everything.
+type envelopeFilter struct {
+	types   map[events.Envelope_EventType]bool
+	origins map[string]bool
+	jobs    map[string]bool
+}
+
+// filterSelection is the form in which a filter is remembered between
+// sessions.
+type filterSelection struct {
+	Types   []string `json:"types,omitempty"`
+	Origins []string `json:"origins,omitempty"`
+	Jobs    []string `json:"jobs,omitempty"`
+}
+
+func newEnvelopeFilter() *envelopeFilter {
+	return &envelopeFilter{
+		types:   make(map[events.Envelope_EventType]bool),
+		origins: make(map[string]bool),
+		jobs:    make(map[string]bool),
+	}
+}
+
+// parseFilter reads a comma-separated list of event types such as
+// LogMessage,Error.
+func parseFilter(names string) (*envelopeFilter, error) {
+	filter := newEnvelopeFilter()
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		envelopeType, ok := events.Envelope_EventType_value[name]
+		if !ok {
+			return nil, fmt.Errorf("Unable to recognize filter %s", name)
+		}
+		filter.types[events.Envelope_EventType(envelopeType)] = true
+	}
+	return filter, nil
+}
+
+func filterFromSelection(selection filterSelection) (*envelopeFilter, error) {
+	filter := newEnvelopeFilter()
+	if len(selection.Types) > 0 {
+		var err error
+		filter, err = parseFilter(strings.Join(selection.Types, ","))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, origin := range selection.Origins {
+		filter.origins[origin] = true
+	}
+	for _, job := range selection.Jobs {
+		filter.jobs[job] = true
+	}
+	return filter, nil
+}
+
+func (f *envelopeFilter) selection() filterSelection {
+	var types []string
+	for envelopeType := range f.types {
+		types = append(types, envelopeType.String())
+	}
+	sort.Strings(types)
+	return filterSelection{Types: types, Origins: sortedKeys(f.origins), Jobs: sortedKeys(f.jobs)}
+}
+
+func (f *envelopeFilter) matches(envelope *events.Envelope) bool {
+	return f.matchesType(envelope.GetEventType()) && f.matchesSource(envelope)
+}
+
+func (f *envelopeFilter) matchesType(envelopeType events.Envelope_EventType) bool {
+	return len(f.types) == 0 || f.types[envelopeType]
+}
+
+func (f *envelopeFilter) matchesSource(envelope *events.Envelope) bool {
+	if len(f.origins) > 0 && !f.origins[envelope.GetOrigin()] {
+		return false
+	}
+	return len(f.jobs) == 0 || f.jobs[envelope.GetJob()]
+}
+
+// description lists what the filter selects, such as
+// "LogMessage, Error from origins gorouter".
+func (f *envelopeFilter) description() string {
+	selection := f.selection()
+	description := "all messages"
+	if len(selection.Types) > 0 {
+		description = strings.Join(selection.Types, ", ")
+	}
+	var sources []string
+	if len(selection.Origins) > 0 {
+		sources = append(sources, "origins "+strings.Join(selection.Origins, ", "))
+	}
+	if len(selection.Jobs) > 0 {
+		sources = append(sources, "jobs "+strings.Join(selection.Jobs, ", "))
+	}
+	if len(sources) > 0 {
+		description += " from " + strings.Join(sources, " and ")
+	}
+	return description
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
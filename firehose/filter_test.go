@@ -0,0 +1,61 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("envelopeFilter", func() {
+	envelope := func(eventType events.Envelope_EventType, origin, job string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String(origin),
+			EventType: eventType.Enum(),
+			Job:       proto.String(job),
+		}
+	}
+
+	It("selects everything when empty", func() {
+		filter := newEnvelopeFilter()
+		Expect(filter.matches(envelope(events.Envelope_LogMessage, "rep", "diego_cell"))).To(BeTrue())
+		Expect(filter.description()).To(Equal("all messages"))
+	})
+
+	It("parses a list of event types", func() {
+		filter, err := parseFilter("LogMessage, Error")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filter.matches(envelope(events.Envelope_LogMessage, "rep", "diego_cell"))).To(BeTrue())
+		Expect(filter.matches(envelope(events.Envelope_Error, "rep", "diego_cell"))).To(BeTrue())
+		Expect(filter.matches(envelope(events.Envelope_ValueMetric, "rep", "diego_cell"))).To(BeFalse())
+		Expect(filter.description()).To(Equal("Error, LogMessage"))
+	})
+
+	It("rejects unknown event types", func() {
+		_, err := parseFilter("LogMessage,Logs")
+		Expect(err).To(MatchError("Unable to recognize filter Logs"))
+	})
+
+	It("selects by origin and job", func() {
+		filter := newEnvelopeFilter()
+		filter.origins["rep"] = true
+		filter.jobs["diego_cell"] = true
+		Expect(filter.matches(envelope(events.Envelope_LogMessage, "rep", "diego_cell"))).To(BeTrue())
+		Expect(filter.matches(envelope(events.Envelope_LogMessage, "gorouter", "diego_cell"))).To(BeFalse())
+		Expect(filter.matches(envelope(events.Envelope_LogMessage, "rep", "router"))).To(BeFalse())
+		Expect(filter.description()).To(Equal("all messages from origins rep and jobs diego_cell"))
+	})
+
+	It("round-trips through a selection", func() {
+		filter, err := parseFilter("HttpStartStop")
+		Expect(err).NotTo(HaveOccurred())
+		filter.origins["gorouter"] = true
+
+		selection := filter.selection()
+		Expect(selection).To(Equal(filterSelection{Types: []string{"HttpStartStop"}, Origins: []string{"gorouter"}}))
+
+		restored, err := filterFromSelection(selection)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.description()).To(Equal("HttpStartStop from origins gorouter"))
+	})
+})
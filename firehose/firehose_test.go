@@ -1,15 +1,27 @@
 package firehose_test
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry/cli/cf/terminal"
 	"github.com/cloudfoundry/cli/cf/trace/tracefakes"
+	io_helpers "github.com/cloudfoundry/cli/testhelpers/io"
 	"github.com/cloudfoundry/firehose-plugin/firehose"
 	"github.com/cloudfoundry/firehose-plugin/firehose/fakes"
 	"github.com/cloudfoundry/firehose-plugin/testhelpers"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -47,7 +59,7 @@ var _ = Describe("Firehose", func() {
 			Context("when the connection to doppler cannot be established", func() {
 				It("shows a meaningful error", func() {
 					client := firehose.NewClient("invalidToken", "badEndpoint", options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("Error dialing trafficcontroller server"))
 				})
 			})
@@ -68,22 +80,29 @@ var _ = Describe("Firehose", func() {
 				It("prints out debug information if demanded", func() {
 					options.Debug = true
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("WEBSOCKET REQUEST"))
 					Expect(stdout).To(ContainSubstring("WEBSOCKET RESPONSE"))
 				})
 				It("shows no debug output if not requested", func() {
 					options.Debug = false
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).ToNot(ContainSubstring("WEBSOCKET REQUEST"))
 					Expect(stdout).ToNot(ContainSubstring("WEBSOCKET RESPONSE"))
 				})
 				It("prints out log messages to the terminal", func() {
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("This is a very special test message"))
 				})
+				It("does not support multiple connections", func() {
+					options.Connections = 2
+					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+					client.Start(context.Background())
+					Expect(stdout).To(ContainSubstring("Multiple connections are only supported for the firehose"))
+					Expect(fakeFirehose.Requested()).To(BeFalse())
+				})
 				Context("in Interactive mode", func() {
 					Context("and the user filters by type", func() {
 						BeforeEach(func() {
@@ -92,19 +111,19 @@ var _ = Describe("Firehose", func() {
 						It("does not show log messages when user wants to see HttpStart", func() {
 							stdin.Write([]byte{'2', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).ToNot(ContainSubstring("This is a very special test message"))
 						})
 						It("shows log messages when the user wants to see log messages", func() {
 							stdin.Write([]byte{'5', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).To(ContainSubstring("This is a very special test message"))
 						})
 						It("shows all messages when user hits enter at filter prompt", func() {
 							stdin.Write([]byte{'\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).To(ContainSubstring("This is a very special test message"))
 							Expect(stdout).To(ContainSubstring("eventType:ValueMetric"))
 							Expect(stdout).To(ContainSubstring("eventType:CounterEvent"))
@@ -117,26 +136,173 @@ var _ = Describe("Firehose", func() {
 						It("shows error message when the user enters an invalid filter", func() {
 							stdin.Write([]byte{'b', 'l', 'a', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 
 							Expect(stdout).To(ContainSubstring("Invalid filter choice bla. Enter an index from 2-9"))
 						})
 						It("shows error message when the user selects invalid filter index", func() {
 							stdin.Write([]byte{'1', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 
 							Expect(stdout).To(ContainSubstring("Invalid filter choice 1"))
 						})
 					})
+					Context("and the user picks several types", func() {
+						BeforeEach(func() {
+							options.NoFilter = false
+						})
+						It("shows the messages of all the types picked", func() {
+							stdin.Write([]byte("4, 5\n"))
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(stdout).To(ContainSubstring("This is a very special test message"))
+							Expect(stdout).To(ContainSubstring("eventType:HttpStartStop"))
+							Expect(stdout).ToNot(ContainSubstring("eventType:ValueMetric"))
+						})
+					})
+					Context("and the user picks origins from a sample", func() {
+						var (
+							answers *io.PipeWriter
+							picked  chan struct{}
+						)
+						BeforeEach(func() {
+							options.NoFilter = false
+							fakeFirehose.SendEnvelope(events.Envelope{
+								Origin:    proto.String("rep"),
+								EventType: events.Envelope_ValueMetric.Enum(),
+								Job:       proto.String("diego_cell"),
+								ValueMetric: &events.ValueMetric{
+									Name:  proto.String("numCPUS"),
+									Value: proto.Float64(4),
+									Unit:  proto.String("count"),
+								},
+							})
+
+							var questions *io.PipeReader
+							questions, answers = io.Pipe()
+							ui = terminal.NewUI(questions, stdout, printer, tracePrinter)
+							picked = make(chan struct{})
+							go func() {
+								defer close(picked)
+								for _, answer := range []string{"6\n", "y\n", "2\n", "\n"} {
+									if _, err := answers.Write([]byte(answer)); err != nil {
+										return
+									}
+								}
+							}()
+						})
+						AfterEach(func() {
+							answers.Close()
+							<-picked
+						})
+						It("only shows the messages of the origins picked", func() {
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(stdout).To(ContainSubstring("The origins seen while sampling:"))
+							Expect(stdout).To(ContainSubstring("1. origin (1)"))
+							Expect(stdout).To(ContainSubstring("2. rep (1)"))
+							Expect(stdout).To(ContainSubstring("The jobs seen while sampling:"))
+							Expect(stdout).To(ContainSubstring("numCPUS"))
+							Expect(stdout).ToNot(ContainSubstring("valuemetric"))
+						})
+					})
+					Context("and the selection is remembered", func() {
+						var dir string
+						BeforeEach(func() {
+							var err error
+							dir, err = ioutil.TempDir("", "nozzle-selection")
+							Expect(err).NotTo(HaveOccurred())
+							options.NoFilter = false
+							options.SelectionFile = filepath.Join(dir, "selections.json")
+							options.SelectionKey = "app-nozzle"
+						})
+						AfterEach(func() {
+							os.RemoveAll(dir)
+						})
+						It("offers the last selection of the command", func() {
+							stdin.Write([]byte("8\n"))
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(stdout).ToNot(ContainSubstring("l for the last selection"))
+
+							stdout.Reset()
+							stdin.Write([]byte("l\n"))
+							client = firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(stdout).To(ContainSubstring("l for the last selection: Error"))
+							Expect(stdout).To(ContainSubstring("Displaying Error"))
+							Expect(stdout).To(ContainSubstring("this is an error"))
+							Expect(stdout).ToNot(ContainSubstring("This is a very special test message"))
+						})
+						It("keeps the selections of other commands", func() {
+							stdin.Write([]byte("8\n"))
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+
+							stdout.Reset()
+							options.SelectionKey = "nozzle"
+							stdin.Write([]byte("\n"))
+							client = firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(stdout).ToNot(ContainSubstring("l for the last selection"))
+						})
+					})
 				})
 				Context("in Non-Interactive mode", func() {
+					It("fails instead of prompting without a default filter", func() {
+						options.NoFilter = false
+						options.NonInteractive = true
+						stdin.Write([]byte{'5', '\n'})
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+
+						Expect(stdout).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+						Expect(stdout).To(ContainSubstring("No filter given and unable to prompt for one in non-interactive mode"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("uses the default filter instead of prompting", func() {
+						options.NoFilter = false
+						options.NonInteractive = true
+						options.DefaultFilter = "ValueMetric"
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+
+						Expect(stdout).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+						Expect(stdout).To(ContainSubstring("eventType:ValueMetric"))
+						Expect(stdout).ToNot(ContainSubstring("This is a very special test message"))
+					})
+
+					It("displays all messages with the default filter all", func() {
+						options.NoFilter = false
+						options.NonInteractive = true
+						options.DefaultFilter = "all"
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+
+						Expect(stdout).To(ContainSubstring("This is a very special test message"))
+						Expect(stdout).To(ContainSubstring("eventType:ValueMetric"))
+					})
+
+					It("prefers the filter to the default filter", func() {
+						options.NoFilter = false
+						options.NonInteractive = true
+						options.Filter = "LogMessage"
+						options.DefaultFilter = "ValueMetric"
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+
+						Expect(stdout).To(ContainSubstring("This is a very special test message"))
+						Expect(stdout).ToNot(ContainSubstring("eventType:ValueMetric"))
+					})
+
 					It("errors for un-recognized filter", func() {
 						options.NoFilter = false
 						options.Filter = "IDontExist"
 						stdin.Write([]byte{'1', '\n'})
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 
 						Expect(stdout).To(ContainSubstring("Unable to recognize filter IDontExist"))
 					})
@@ -144,42 +310,42 @@ var _ = Describe("Firehose", func() {
 					It("filters by LogMessage", func() {
 						options.Filter = "LogMessage"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("This is a very special test message"))
 					})
 
 					It("filters by ValueMetric", func() {
 						options.Filter = "ValueMetric"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("valueMetric:<name:\"valuemetric\" value:42 unit:\"unit\""))
 					})
 
 					It("filters by CounterEvent", func() {
 						options.Filter = "CounterEvent"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("counterEvent:<name:\"counterevent\" delta:42"))
 					})
 
 					It("filters by ContainerMetric", func() {
 						options.Filter = "ContainerMetric"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("containerMetric:<applicationId:\"containermetric\" instanceIndex:1 cpuPercentage:1 memoryBytes:1 diskBytes:1"))
 					})
 
 					It("filters by Error", func() {
 						options.Filter = "Error"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("error:<source:\"source\" code:404 message:\"this is an error\""))
 					})
 
 					It("filters by HttpStart", func() {
 						options.Filter = "HttpStart"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStart:<timestamp:12 "))
 						Expect(stdout).To(ContainSubstring("userAgent:\"start request\""))
 					})
@@ -187,7 +353,7 @@ var _ = Describe("Firehose", func() {
 					It("filters by HttpStop", func() {
 						options.Filter = "HttpStop"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStop:<timestamp:12 "))
 						Expect(stdout).To(ContainSubstring("uri:\"http://stop.example.com\""))
 					})
@@ -195,7 +361,7 @@ var _ = Describe("Firehose", func() {
 					It("filters by HttpStartStop", func() {
 						options.Filter = "HttpStartStop"
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStartStop:<startTimestamp:1234 stopTimestamp:5555 "))
 						Expect(stdout).To(ContainSubstring("userAgent:\"test\""))
 						Expect(stdout).To(ContainSubstring("uri:\"http://startstop.example.com\""))
@@ -204,7 +370,7 @@ var _ = Describe("Firehose", func() {
 					It("does not filter when NoFilter is true", func() {
 						options.NoFilter = true
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
 					})
 				})
@@ -218,7 +384,7 @@ var _ = Describe("Firehose", func() {
 			Context("when the connection to doppler cannot be established", func() {
 				It("shows a meaningful error", func() {
 					client := firehose.NewClient("invalidToken", "badEndpoint", options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("Error dialing trafficcontroller server"))
 				})
 			})
@@ -239,21 +405,21 @@ var _ = Describe("Firehose", func() {
 				It("prints out debug information if demanded", func() {
 					options = &firehose.ClientOptions{Debug: true}
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("WEBSOCKET REQUEST"))
 					Expect(stdout).To(ContainSubstring("WEBSOCKET RESPONSE"))
 				})
 				It("shows no debug output if not requested", func() {
 					options = &firehose.ClientOptions{Debug: false}
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).ToNot(ContainSubstring("WEBSOCKET REQUEST"))
 					Expect(stdout).ToNot(ContainSubstring("WEBSOCKET RESPONSE"))
 				})
 				It("prints out log messages to the terminal", func() {
 					options = &firehose.ClientOptions{Debug: false, NoFilter: true}
 					client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-					client.Start()
+					client.Start(context.Background())
 					Expect(stdout).To(ContainSubstring("This is a very special test message"))
 				})
 
@@ -265,19 +431,19 @@ var _ = Describe("Firehose", func() {
 						It("does not show log messages when user wants to see HttpStart", func() {
 							stdin.Write([]byte{'2', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).ToNot(ContainSubstring("This is a very special test message"))
 						})
 						It("shows log messages when the user wants to see log messages", func() {
 							stdin.Write([]byte{'5', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).To(ContainSubstring("This is a very special test message"))
 						})
 						It("shows all messages when user hits enter at filter prompt", func() {
 							stdin.Write([]byte{'\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 							Expect(stdout).To(ContainSubstring("This is a very special test message"))
 							Expect(stdout).To(ContainSubstring("eventType:ValueMetric"))
 							Expect(stdout).To(ContainSubstring("eventType:CounterEvent"))
@@ -290,14 +456,14 @@ var _ = Describe("Firehose", func() {
 						It("shows error message when the user enters an invalid filter", func() {
 							stdin.Write([]byte{'b', 'l', 'a', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 
 							Expect(stdout).To(ContainSubstring("Invalid filter choice bla. Enter an index from 2-9"))
 						})
 						It("shows error message when the user selects invalid filter index", func() {
 							stdin.Write([]byte{'1', '\n'})
 							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-							client.Start()
+							client.Start(context.Background())
 
 							Expect(stdout).To(ContainSubstring("Invalid filter choice 1"))
 						})
@@ -308,7 +474,7 @@ var _ = Describe("Firehose", func() {
 						options = &firehose.ClientOptions{Filter: "IDontExist"}
 						stdin.Write([]byte{'1', '\n'})
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 
 						Expect(stdout).To(ContainSubstring("Unable to recognize filter IDontExist"))
 					})
@@ -316,42 +482,42 @@ var _ = Describe("Firehose", func() {
 					It("filters by LogMessage", func() {
 						options = &firehose.ClientOptions{Filter: "LogMessage"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("This is a very special test message"))
 					})
 
 					It("filters by ValueMetric", func() {
 						options = &firehose.ClientOptions{Filter: "ValueMetric"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("valueMetric:<name:\"valuemetric\" value:42 unit:\"unit\""))
 					})
 
 					It("filters by CounterEvent", func() {
 						options := &firehose.ClientOptions{Filter: "CounterEvent"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("counterEvent:<name:\"counterevent\" delta:42"))
 					})
 
 					It("filters by ContainerMetric", func() {
 						options = &firehose.ClientOptions{Filter: "ContainerMetric"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("containerMetric:<applicationId:\"containermetric\" instanceIndex:1 cpuPercentage:1 memoryBytes:1 diskBytes:1"))
 					})
 
 					It("filters by Error", func() {
 						options = &firehose.ClientOptions{Filter: "Error"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("error:<source:\"source\" code:404 message:\"this is an error\""))
 					})
 
 					It("filters by HttpStart", func() {
 						options = &firehose.ClientOptions{Filter: "HttpStart"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStart:<timestamp:12 "))
 						Expect(stdout).To(ContainSubstring("userAgent:\"start request\""))
 					})
@@ -359,7 +525,7 @@ var _ = Describe("Firehose", func() {
 					It("filters by HttpStop", func() {
 						options = &firehose.ClientOptions{Filter: "HttpStop"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStop:<timestamp:12 "))
 						Expect(stdout).To(ContainSubstring("uri:\"http://stop.example.com\""))
 					})
@@ -367,7 +533,7 @@ var _ = Describe("Firehose", func() {
 					It("filters by HttpStartStop", func() {
 						options = &firehose.ClientOptions{Filter: "HttpStartStop"}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(stdout).To(ContainSubstring("httpStartStop:<startTimestamp:1234 stopTimestamp:5555 "))
 						Expect(stdout).To(ContainSubstring("userAgent:\"test\""))
 						Expect(stdout).To(ContainSubstring("uri:\"http://startstop.example.com\""))
@@ -376,25 +542,715 @@ var _ = Describe("Firehose", func() {
 					It("does not filter when NoFilter is true", func() {
 						options = &firehose.ClientOptions{NoFilter: true}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
 					})
 
 					It("uses specified subscription id", func() {
 						options = &firehose.ClientOptions{SubscriptionID: "myFirehose", NoFilter: true}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(fakeFirehose.SubscriptionID()).To(Equal("myFirehose"))
 					})
 
 					It("uses default subscription id if none specified", func() {
 						options = &firehose.ClientOptions{Filter: "LogMessage", Debug: true}
 						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
-						client.Start()
+						client.Start(context.Background())
 						Expect(fakeFirehose.SubscriptionID()).To(Equal("FirehosePlugin"))
 					})
 				})
+				Context("when the session ends", func() {
+					It("prints a summary of received and displayed messages", func() {
+						options = &firehose.ClientOptions{Filter: "LogMessage"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Session summary:"))
+						Expect(stdout).To(ContainSubstring("LogMessage: 1 received, 1 displayed"))
+						Expect(stdout).To(ContainSubstring("ValueMetric: 1 received, 0 displayed"))
+						Expect(stdout).To(ContainSubstring("errors: 1"))
+					})
+
+					Context("because it was interrupted", func() {
+						BeforeEach(func() {
+							fakeFirehose.KeepConnectionAlive()
+						})
+
+						AfterEach(func() {
+							fakeFirehose.CloseAliveConnection()
+						})
+
+						It("closes the connection and prints a summary", func() {
+							options = &firehose.ClientOptions{NoFilter: true}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							go func() {
+								defer GinkgoRecover()
+								Eventually(func() int { return strings.Count(stdout.String(), "eventType:") }).Should(Equal(8))
+								Expect(client.Interrupt()).To(BeTrue())
+							}()
+							Expect(client.Start(context.Background())).To(Equal(firehose.ErrStopped))
+							Expect(stdout).To(ContainSubstring("Stopping the nozzle: interrupted"))
+							Expect(stdout).To(ContainSubstring("HttpStartStop: 1 received, 1 displayed"))
+							Expect(stdout).To(ContainSubstring("errors: 0"))
+							Expect(client.StopConditionMet()).To(BeFalse())
+						})
+
+						It("waits for the session to end when stopped", func() {
+							options = &firehose.ClientOptions{NoFilter: true}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							result := make(chan error, 1)
+							go func() {
+								result <- client.Start(context.Background())
+							}()
+							Eventually(func() int { return strings.Count(stdout.String(), "eventType:") }).Should(Equal(8))
+							client.Stop()
+							Expect(result).To(Receive(Equal(firehose.ErrStopped)))
+							Expect(stdout).To(ContainSubstring("Session summary:"))
+						})
+
+						It("stops when the context is cancelled", func() {
+							options = &firehose.ClientOptions{NoFilter: true}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							ctx, cancel := context.WithCancel(context.Background())
+							go func() {
+								defer GinkgoRecover()
+								Eventually(func() int { return strings.Count(stdout.String(), "eventType:") }).Should(Equal(8))
+								cancel()
+							}()
+							Expect(client.Start(ctx)).To(Equal(context.Canceled))
+							Expect(stdout).To(ContainSubstring("Stopping the nozzle: context canceled"))
+							Expect(stdout).To(ContainSubstring("errors: 0"))
+						})
+					})
+
+					It("returns the error that closed the connection", func() {
+						options = &firehose.ClientOptions{NoFilter: true}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						err := client.Start(context.Background())
+						Expect(err).To(HaveOccurred())
+						Expect(err).ToNot(Equal(firehose.ErrStopped))
+					})
+
+					It("returns the error that prevented it from starting", func() {
+						options = &firehose.ClientOptions{Filter: "Nothing"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Start(context.Background())).To(HaveOccurred())
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("does not interrupt a session that has not started", func() {
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Interrupt()).To(BeFalse())
+					})
+
+					It("stays stopped once stopped", func() {
+						options = &firehose.ClientOptions{NoFilter: true}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Stop()
+						Expect(client.Start(context.Background())).To(Equal(firehose.ErrStopped))
+						Expect(client.Start(context.Background())).To(Equal(firehose.ErrStopped))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("starts again after a session ends on its own", func() {
+						options = &firehose.ClientOptions{NoFilter: true}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Start(context.Background())).ToNot(Equal(firehose.ErrStopped))
+						Expect(client.Start(context.Background())).ToNot(Equal(firehose.ErrStopped))
+						Expect(strings.Count(stdout.String(), "Starting the nozzle")).To(Equal(2))
+					})
+
+					It("stops while prompting for the filter type", func() {
+						questions, answers := io.Pipe()
+						defer answers.Close()
+						ui = terminal.NewUI(questions, stdout, printer, tracePrinter)
+						options = &firehose.ClientOptions{}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						result := make(chan error, 1)
+						go func() {
+							result <- client.Start(context.Background())
+						}()
+
+						Eventually(stdout.String).Should(ContainSubstring("What type of firehose messages do you want to see?"))
+						client.Stop()
+						Expect(result).To(Receive(Equal(firehose.ErrStopped)))
+						Expect(stdout).To(ContainSubstring("Stopping the nozzle: interrupted"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					Context("while picking a filter", func() {
+						var answers *io.PipeWriter
+
+						BeforeEach(func() {
+							fakeFirehose.KeepConnectionAlive()
+							var questions *io.PipeReader
+							questions, answers = io.Pipe()
+							ui = terminal.NewUI(questions, stdout, printer, tracePrinter)
+							go func() {
+								for _, answer := range []string{"\n", "y\n"} {
+									if _, err := answers.Write([]byte(answer)); err != nil {
+										return
+									}
+								}
+							}()
+						})
+
+						AfterEach(func() {
+							answers.Close()
+							fakeFirehose.CloseAliveConnection()
+						})
+
+						It("stops while sampling the stream", func() {
+							options = &firehose.ClientOptions{}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							result := make(chan error, 1)
+							go func() {
+								result <- client.Start(context.Background())
+							}()
+
+							Eventually(stdout.String).Should(ContainSubstring("Sampling the stream"))
+							client.Stop()
+							Expect(result).To(Receive(Equal(firehose.ErrStopped)))
+							Expect(stdout).To(ContainSubstring("Stopping the nozzle: interrupted"))
+							Expect(stdout).ToNot(ContainSubstring("seen while sampling"))
+							Expect(stdout).ToNot(ContainSubstring("Starting the nozzle"))
+						})
+					})
+				})
+
+				Context("with multiple connections", func() {
+					It("merges the messages of every connection", func() {
+						options = &firehose.ClientOptions{NoFilter: true, SubscriptionID: "myFirehose", Connections: 3}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Starting the nozzle with 3 connections"))
+						Expect(fakeFirehose.Connections()).To(Equal(3))
+						Expect(fakeFirehose.SubscriptionID()).To(Equal("myFirehose"))
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(24))
+						Expect(stdout).To(ContainSubstring("errors: 3"))
+					})
+				})
+
+				Context("with a buffer policy", func() {
+					It("errors for an un-recognized policy", func() {
+						options = &firehose.ClientOptions{NoFilter: true, BufferPolicy: "IDontExist"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to recognize buffer policy IDontExist"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("reports how many messages were dropped", func() {
+						options = &firehose.ClientOptions{NoFilter: true, BufferSize: 100, BufferPolicy: "drop-oldest"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
+						Expect(stdout).To(ContainSubstring("dropped by buffer: 0"))
+					})
+
+					for _, policy := range []string{"drop-oldest", "drop-newest", "sample"} {
+						policy := policy
+						It(fmt.Sprintf("drops messages for a slow display with %s", policy), func() {
+							var blocked bool
+							printer.PrintfStub = func(format string, a ...interface{}) (n int, err error) {
+								if !blocked && strings.Contains(fmt.Sprintf(format, a...), "eventType:") {
+									blocked = true
+									time.Sleep(200 * time.Millisecond)
+								}
+								return fmt.Fprintf(stdout, format, a...)
+							}
+							options = &firehose.ClientOptions{NoFilter: true, BufferSize: 1, BufferPolicy: policy}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(strings.Count(stdout.String(), "eventType:")).To(BeNumerically("<", 8))
+							Expect(stdout).To(MatchRegexp(`dropped by buffer: [1-9]`))
+						})
+					}
+				})
+
+				Context("with sampling", func() {
+					It("errors for an invalid sample rate", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Sample: "often"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to parse sample rate often"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("shows the sampling rate in the banner and the summary", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Sample: "1/1"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Sampling 1/1 of all messages"))
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
+						Expect(stdout).To(ContainSubstring("sampling 1/1 of all messages: kept 8 of 8 messages (100.0%)"))
+					})
+
+					It("samples messages per key", func() {
+						options = &firehose.ClientOptions{NoFilter: true, SamplePerKey: "origin,job", SampleReservoir: 1}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Sampling up to 1 messages per origin,job every 1s"))
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(1))
+						Expect(stdout).To(ContainSubstring("kept 1 of 8 messages (12.5%)"))
+					})
+
+					Context("when the session ends within a sampling window", func() {
+						BeforeEach(func() {
+							fakeFirehose.KeepConnectionAlive()
+						})
+
+						AfterEach(func() {
+							fakeFirehose.CloseAliveConnection()
+						})
+
+						It("shows the sampled messages when the duration is reached", func() {
+							options = &firehose.ClientOptions{NoFilter: true, SamplePerKey: "origin,job", SampleReservoir: 1, Duration: 100 * time.Millisecond}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(1))
+							Expect(stdout).To(ContainSubstring("kept 1 of 8 messages (12.5%)"))
+						})
+
+						It("shows the sampled messages when the context is done", func() {
+							options = &firehose.ClientOptions{NoFilter: true, SamplePerKey: "origin,job", SampleReservoir: 1}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+							defer cancel()
+							client.Start(ctx)
+							Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(1))
+						})
+					})
+				})
+
+				Context("with a maximum rate", func() {
+					It("errors for an invalid rate", func() {
+						options = &firehose.ClientOptions{NoFilter: true, MaxRate: "fast"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to parse rate fast"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("suppresses messages above the rate and reports them", func() {
+						options = &firehose.ClientOptions{NoFilter: true, MaxRate: "2/s"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Displaying at most 2/s messages"))
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(2))
+						Expect(stdout).To(ContainSubstring("... 6 envelopes suppressed in last"))
+						Expect(stdout).To(ContainSubstring("(HttpStart: 1, HttpStop: 1, HttpStartStop: 1, CounterEvent: 1, Error: 1, ContainerMetric: 1)"))
+						Expect(stdout).To(ContainSubstring("suppressed by rate limit of 2/s: 6"))
+					})
+				})
+
+				Context("with deduplication", func() {
+					BeforeEach(func() {
+						fakeFirehose.SendEvent(events.Envelope_LogMessage, "This is a very special test message")
+						fakeFirehose.SendEvent(events.Envelope_LogMessage, "This is a very special test message")
+					})
+
+					It("collapses repeated messages into a count", func() {
+						options = &firehose.ClientOptions{Filter: "LogMessage", Dedupe: time.Minute}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(1))
+						Expect(stdout).To(ContainSubstring("... repeated 2 more times in last 1m0s: LogMessage: This is a very special test message"))
+						Expect(stdout).To(ContainSubstring("collapsed as duplicates: 2"))
+					})
+				})
+
+				Context("with a request trace", func() {
+					const requestID = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+					BeforeEach(func() {
+						fakeFirehose.SendEvent(events.Envelope_LogMessage, "GET /tracked x_vcap_request_id:"+requestID)
+						fakeFirehose.SendEnvelope(events.Envelope{
+							Origin:    proto.String("gorouter"),
+							EventType: events.Envelope_HttpStartStop.Enum(),
+							HttpStartStop: &events.HttpStartStop{
+								StartTimestamp: proto.Int64(1234),
+								StopTimestamp:  proto.Int64(5555),
+								RequestId:      &events.UUID{Low: proto.Uint64(0xd111ad9d10b8a76b), High: proto.Uint64(0xc830d44fc000b480)},
+								PeerType:       events.PeerType_Server.Enum(),
+								Method:         events.Method_GET.Enum(),
+								Uri:            proto.String("http://tracked.example.com"),
+								RemoteAddress:  proto.String("10.0.0.1:4567"),
+								UserAgent:      proto.String("curl"),
+								StatusCode:     proto.Int32(200),
+								ContentLength:  proto.Int64(42),
+							},
+						})
+					})
+
+					It("only displays the messages correlated with the request", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Trace: requestID}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Tracing request " + requestID))
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(2))
+						Expect(stdout).To(ContainSubstring("GET /tracked"))
+						Expect(stdout).To(ContainSubstring("http://tracked.example.com"))
+					})
+
+					It("rejects a malformed request ID", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Trace: "abc"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to parse request ID abc"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+				})
+
+				Context("with stitching", func() {
+					BeforeEach(func() {
+						requestID := &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)}
+						fakeFirehose.SendEnvelope(events.Envelope{
+							Origin:    proto.String("cc"),
+							EventType: events.Envelope_HttpStart.Enum(),
+							HttpStart: &events.HttpStart{
+								Timestamp:     proto.Int64(1000000),
+								RequestId:     requestID,
+								PeerType:      events.PeerType_Server.Enum(),
+								Method:        events.Method_PUT.Enum(),
+								Uri:           proto.String("http://stitched.example.com"),
+								RemoteAddress: proto.String("10.0.0.1:4567"),
+								UserAgent:     proto.String("curl"),
+							},
+						})
+						fakeFirehose.SendEnvelope(events.Envelope{
+							Origin:    proto.String("cc"),
+							EventType: events.Envelope_HttpStop.Enum(),
+							HttpStop: &events.HttpStop{
+								Timestamp:     proto.Int64(6000000),
+								Uri:           proto.String("http://stitched.example.com"),
+								RequestId:     requestID,
+								PeerType:      events.PeerType_Server.Enum(),
+								StatusCode:    proto.Int32(200),
+								ContentLength: proto.Int64(42),
+							},
+						})
+					})
+
+					It("combines the halves of a request and reports orphans", func() {
+						options = &firehose.ClientOptions{Filter: "HttpStart", Stitch: time.Minute}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Stitching HttpStart and HttpStop events within 1m0s"))
+						Expect(stdout).To(ContainSubstring("Request 01000000-0000-0000-0200-000000000000 (Server): PUT http://stitched.example.com returned 200 with 42 bytes in 5ms"))
+						Expect(stdout).To(ContainSubstring("Orphaned HttpStart for request"))
+						Expect(stdout).To(ContainSubstring("Orphaned HttpStop for request"))
+						Expect(stdout).ToNot(ContainSubstring("eventType:"))
+						Expect(stdout).To(ContainSubstring("stitched requests: 1, orphaned events: 2"))
+					})
+
+					It("counts stitched requests towards the stop conditions", func() {
+						options = &firehose.ClientOptions{Filter: "HttpStart", Stitch: time.Minute, Count: 1}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Start(context.Background())).To(Succeed())
+						Expect(stdout).To(ContainSubstring("PUT http://stitched.example.com returned 200"))
+						Expect(stdout).To(ContainSubstring("Stopping the nozzle: reached count of 1"))
+						Expect(stdout).To(ContainSubstring("HttpStartStop: 1 received, 1 displayed"))
+					})
+
+					It("hands stitched requests to the sinks", func() {
+						options = &firehose.ClientOptions{Filter: "HttpStart", Stitch: time.Minute, NoDisplay: true}
+						sink := &recordingSink{}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.AddSink(sink)
+						client.Start(context.Background())
+						Expect(stdout).ToNot(ContainSubstring("PUT http://stitched.example.com"))
+						Expect(sink.envelopes).To(HaveLen(1))
+						request := sink.envelopes[0].GetHttpStartStop()
+						Expect(request.GetUri()).To(Equal("http://stitched.example.com"))
+						Expect(request.GetStatusCode()).To(Equal(int32(200)))
+						Expect(request.GetStopTimestamp() - request.GetStartTimestamp()).To(Equal(int64(5000000)))
+					})
+				})
+
+				Context("with a Prometheus exporter", func() {
+					Context("while the session runs", func() {
+						BeforeEach(func() {
+							fakeFirehose.KeepConnectionAlive()
+						})
+
+						AfterEach(func() {
+							fakeFirehose.CloseAliveConnection()
+						})
+
+						It("serves the metrics", func() {
+							options = &firehose.ClientOptions{NoFilter: true, NoDisplay: true, Prometheus: "127.0.0.1:0"}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							result := make(chan error, 1)
+							go func() {
+								result <- client.Start(context.Background())
+							}()
+
+							address := regexp.MustCompile(`Serving Prometheus metrics on (http://\S+)`)
+							Eventually(stdout.String).Should(MatchRegexp(address.String()))
+							url := address.FindStringSubmatch(stdout.String())[1]
+							scrape := func() string {
+								response, err := http.Get(url)
+								if err != nil {
+									return err.Error()
+								}
+								defer response.Body.Close()
+								body, _ := ioutil.ReadAll(response.Body)
+								return string(body)
+							}
+							Eventually(scrape).Should(ContainSubstring("# TYPE valuemetric gauge"))
+							Expect(scrape()).To(MatchRegexp(`valuemetric\{[^}]*origin="origin"[^}]*\} 42`))
+
+							client.Stop()
+							Expect(result).To(Receive(Equal(firehose.ErrStopped)))
+							Expect(stdout).ToNot(ContainSubstring("eventType:"))
+						})
+					})
+
+					It("refuses to export metrics that other options thin out", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Prometheus: "127.0.0.1:0", MaxRate: "10/s"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Start(context.Background())).To(HaveOccurred())
+						Expect(stdout).To(ContainSubstring("Unable to export Prometheus metrics with --max-rate"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("does not connect when the address cannot be used", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Prometheus: "not-an-address"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to serve Prometheus metrics on not-an-address"))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+				})
+
+				Context("with a metric output format", func() {
+					It("writes the metrics to stdout instead of displaying the messages", func() {
+						options = &firehose.ClientOptions{NoFilter: true, NoDisplay: true, Output: "graphite"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						output := strings.Join(io_helpers.CaptureOutput(func() {
+							client.Start(context.Background())
+						}), "\n")
+						Expect(output).To(ContainSubstring("deployment-name.doppler.origin.valuemetric 42 1\n"))
+						Expect(output).To(ContainSubstring("deployment-name.doppler.origin.counterevent.delta 42 1\n"))
+						Expect(output).ToNot(ContainSubstring("Starting the nozzle"))
+						Expect(stdout).To(ContainSubstring("Starting the nozzle"))
+						Expect(stdout).ToNot(ContainSubstring("valuemetric 42"))
+						Expect(stdout).ToNot(ContainSubstring("eventType:"))
+					})
+
+					It("rejects an unknown format", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Output: "csv"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to recognize output format csv"))
+					})
+				})
+
+				Context("with statsd", func() {
+					It("sends the metrics to the given address", func() {
+						conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+						Expect(err).NotTo(HaveOccurred())
+						defer conn.Close()
+
+						options = &firehose.ClientOptions{Filter: "CounterEvent", NoDisplay: true, Statsd: conn.LocalAddr().String(), StatsdTemplate: "{job}.{name}"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Sending metrics to statsd at " + conn.LocalAddr().String()))
+
+						buffer := make([]byte, 1024)
+						n, _, err := conn.ReadFrom(buffer)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(buffer[:n])).To(Equal("doppler.counterevent:42|c"))
+					})
+				})
+
+				Context("with an output file", func() {
+					It("writes the displayed messages to the file", func() {
+						dir, err := ioutil.TempDir("", "nozzle-output")
+						Expect(err).NotTo(HaveOccurred())
+						defer os.RemoveAll(dir)
+						path := filepath.Join(dir, "nozzle.log")
+
+						options = &firehose.ClientOptions{Filter: "LogMessage", OutputFile: path}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Writing messages to " + path))
+						Expect(stdout).To(ContainSubstring("This is a very special test message"))
+
+						data, err := ioutil.ReadFile(path)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).To(ContainSubstring("This is a very special test message"))
+						Expect(string(data)).ToNot(ContainSubstring("valuemetric"))
+					})
+				})
+
+				Context("with a ring buffer", func() {
+					It("dumps the messages received before a matching one, whatever their type", func() {
+						dir, err := ioutil.TempDir("", "nozzle-ring")
+						Expect(err).NotTo(HaveOccurred())
+						defer os.RemoveAll(dir)
+
+						options = &firehose.ClientOptions{Filter: "Error", Ring: 10, RingTrigger: "this is an error", RingDir: dir}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Keeping the last 10 messages to dump into " + dir))
+						Expect(stdout).To(ContainSubstring(": found a message matching this is an error"))
+						Expect(stdout).ToNot(ContainSubstring("valuemetric"))
+
+						dumps, err := filepath.Glob(filepath.Join(dir, "nozzle-ring-*.log"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(dumps).To(HaveLen(1))
+						data, err := ioutil.ReadFile(dumps[0])
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(data)).To(ContainSubstring("This is a very special test message"))
+						Expect(string(data)).To(ContainSubstring("valuemetric"))
+						Expect(string(data)).To(ContainSubstring("this is an error"))
+					})
+
+					It("dumps only once for messages matching one after another", func() {
+						dir, err := ioutil.TempDir("", "nozzle-ring")
+						Expect(err).NotTo(HaveOccurred())
+						defer os.RemoveAll(dir)
+
+						options = &firehose.ClientOptions{NoFilter: true, Ring: 10, RingTrigger: "eventType", RingDir: dir}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
+						Expect(strings.Count(stdout.String(), "Dumped the last")).To(Equal(1))
+
+						dumps, err := filepath.Glob(filepath.Join(dir, "nozzle-ring-*.log"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(dumps).To(HaveLen(1))
+					})
+				})
+
+				Context("with a sink", func() {
+					It("hands the displayed messages to the sink", func() {
+						options = &firehose.ClientOptions{Filter: "LogMessage", NoDisplay: true}
+						patterns := firehose.NewPatternCollector()
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.AddSink(patterns)
+						client.Start(context.Background())
+						Expect(stdout).ToNot(ContainSubstring("eventType:"))
+
+						patterns.Print(ui, 10)
+						Expect(stdout).To(ContainSubstring("Top 1 of 1 log patterns from 1 messages:"))
+						Expect(stdout).To(ContainSubstring("1. 1 (100.0%)  This is a very special test message"))
+					})
+				})
+
+				Context("when doppler reports a slow consumer", func() {
+					It("warns about dropped messages and counts them in the summary", func() {
+						fakeFirehose.SendEvent(events.Envelope_CounterEvent, "TruncatingBuffer.DroppedMessages")
+						fakeFirehose.SendEvent(events.Envelope_LogMessage, "Log message output is too high. 100 messages dropped (Total 100 messages dropped).")
+						options = &firehose.ClientOptions{Filter: "ValueMetric"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Slow consumer: origin dropped 42 messages"))
+						Expect(stdout).To(ContainSubstring("Slow consumer: Log message output is too high. 100 messages dropped"))
+						Expect(strings.Count(stdout.String(), "Hint: the nozzle is not keeping up")).To(Equal(1))
+						Expect(stdout).To(ContainSubstring("slow consumer alerts: 2"))
+						Expect(stdout).To(ContainSubstring("the output above is incomplete"))
+					})
+
+					It("recognizes a policy violation disconnect", func() {
+						fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+						options = &firehose.ClientOptions{NoFilter: true}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Slow consumer: doppler closed the connection: Client did not respond to ping"))
+						Expect(stdout).To(ContainSubstring("slow consumer alerts: 1"))
+					})
+
+					It("does not warn when nothing was dropped", func() {
+						options = &firehose.ClientOptions{NoFilter: true}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).ToNot(ContainSubstring("Slow consumer"))
+						Expect(stdout).To(ContainSubstring("slow consumer alerts: 0"))
+					})
+				})
+
+				Context("with stop conditions", func() {
+					It("stops after displaying the requested number of messages", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Count: 3}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						Expect(client.Start(context.Background())).To(Succeed())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(3))
+						Expect(stdout).To(ContainSubstring("Stopping the nozzle: reached count of 3"))
+						Expect(client.StopConditionMet()).To(BeTrue())
+					})
+
+					It("counts only messages that pass the filter", func() {
+						options = &firehose.ClientOptions{Filter: "HttpStop", Count: 1}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(1))
+						Expect(stdout).To(ContainSubstring("eventType:HttpStop"))
+						Expect(client.StopConditionMet()).To(BeTrue())
+					})
+
+					It("stops after a message matches the pattern", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Until: "counter.vent"}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("counterEvent:<name:\"counterevent\""))
+						Expect(stdout).ToNot(ContainSubstring("eventType:ContainerMetric"))
+						Expect(stdout).To(ContainSubstring("Stopping the nozzle: found a message matching counter.vent"))
+						Expect(client.StopConditionMet()).To(BeTrue())
+					})
+
+					It("errors for an invalid pattern", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Until: "("}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(stdout).To(ContainSubstring("Unable to parse pattern ("))
+						Expect(fakeFirehose.Requested()).To(BeFalse())
+					})
+
+					It("reports when the connection closes before a condition is met", func() {
+						options = &firehose.ClientOptions{NoFilter: true, Count: 100}
+						client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+						client.Start(context.Background())
+						Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
+						Expect(client.StopConditionMet()).To(BeFalse())
+					})
+
+					Context("when the connection stays open", func() {
+						BeforeEach(func() {
+							fakeFirehose.KeepConnectionAlive()
+						})
+
+						AfterEach(func() {
+							fakeFirehose.CloseAliveConnection()
+						})
+
+						It("stops after the requested duration", func() {
+							options = &firehose.ClientOptions{NoFilter: true, Duration: 100 * time.Millisecond}
+							client := firehose.NewClient("ACCESS_TOKEN", fakeFirehose.URL(), options, ui)
+							client.Start(context.Background())
+							Expect(strings.Count(stdout.String(), "eventType:")).To(Equal(8))
+							Expect(stdout).To(ContainSubstring("Stopping the nozzle: reached duration of 100ms"))
+							Expect(stdout).ToNot(ContainSubstring("websocket: close"))
+							Expect(client.StopConditionMet()).To(BeTrue())
+						})
+					})
+				})
 			})
 		})
 	})
 })
+
+// recordingSink keeps the envelopes written to it.
+type recordingSink struct {
+	envelopes []*events.Envelope
+}
+
+func (s *recordingSink) Write(envelope *events.Envelope) error {
+	s.envelopes = append(s.envelopes, envelope)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package firehose
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// mergeStreams fans several envelope and error streams into one of each, in
+// order of arrival. The merged channels close once every source has closed.
+func mergeStreams(outputs []<-chan *events.Envelope, errs []<-chan error) (<-chan *events.Envelope, <-chan error) {
+	if len(outputs) == 1 && len(errs) == 1 {
+		return outputs[0], errs[0]
+	}
+
+	mergedOutput := make(chan *events.Envelope)
+	mergedErrors := make(chan error)
+
+	var outputWG sync.WaitGroup
+	outputWG.Add(len(outputs))
+	for _, output := range outputs {
+		go func(output <-chan *events.Envelope) {
+			defer outputWG.Done()
+			for envelope := range output {
+				mergedOutput <- envelope
+			}
+		}(output)
+	}
+
+	var errorWG sync.WaitGroup
+	errorWG.Add(len(errs))
+	for _, errors := range errs {
+		go func(errors <-chan error) {
+			defer errorWG.Done()
+			for err := range errors {
+				mergedErrors <- err
+			}
+		}(errors)
+	}
+
+	go func() {
+		outputWG.Wait()
+		close(mergedOutput)
+	}()
+	go func() {
+		errorWG.Wait()
+		close(mergedErrors)
+	}()
+
+	return mergedOutput, mergedErrors
+}
@@ -0,0 +1,219 @@
+package firehose
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var invalidGraphiteChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// metricWriter is a Sink that writes ValueMetrics, CounterEvents and
+// ContainerMetrics in the InfluxDB line protocol or the Graphite plaintext
+// protocol, keeping the envelope timestamps.
+type metricWriter struct {
+	format      func(*events.Envelope) []string
+	destination io.Writer
+	closer      io.Closer
+}
+
+// newMetricWriter writes in the given format to a tcp:// or udp:// address,
+// or to stdout when the address is empty.
+func newMetricWriter(format, address string) (*metricWriter, error) {
+	w := &metricWriter{}
+	switch format {
+	case "influx":
+		w.format = influxLines
+	case "graphite":
+		w.format = graphiteLines
+	default:
+		return nil, fmt.Errorf("Unable to recognize output format %s. Use influx or graphite", format)
+	}
+
+	if address == "" {
+		w.destination = os.Stdout
+		return w, nil
+	}
+
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "udp") {
+		return nil, fmt.Errorf("Unable to parse output address %s. Use tcp://HOST:PORT or udp://HOST:PORT", address)
+	}
+	conn, err := net.Dial(parts[0], parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", address, err)
+	}
+	w.destination = conn
+	w.closer = conn
+	return w, nil
+}
+
+// Write sends every line on its own, so that each line becomes a single
+// datagram over UDP.
+func (w *metricWriter) Write(envelope *events.Envelope) error {
+	for _, line := range w.format(envelope) {
+		if _, err := io.WriteString(w.destination, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *metricWriter) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+func envelopeTime(envelope *events.Envelope) time.Time {
+	if envelope.GetTimestamp() == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, envelope.GetTimestamp())
+}
+
+func influxLines(envelope *events.Envelope) []string {
+	tags := map[string]string{
+		"origin":     envelope.GetOrigin(),
+		"deployment": envelope.GetDeployment(),
+		"job":        envelope.GetJob(),
+		"index":      envelope.GetIndex(),
+		"ip":         envelope.GetIp(),
+	}
+	for name, value := range envelope.GetTags() {
+		tags[name] = value
+	}
+
+	var measurement string
+	var fields []string
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		metric := envelope.GetValueMetric()
+		measurement = metric.GetName()
+		tags["unit"] = metric.GetUnit()
+		fields = append(fields, "value="+formatFloat(metric.GetValue()))
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		measurement = counter.GetName()
+		fields = append(fields, fmt.Sprintf("delta=%di", counter.GetDelta()))
+		if counter.Total != nil {
+			fields = append(fields, fmt.Sprintf("total=%di", counter.GetTotal()))
+		}
+	case events.Envelope_ContainerMetric:
+		metric := envelope.GetContainerMetric()
+		measurement = "container_metric"
+		tags["application_id"] = metric.GetApplicationId()
+		tags["instance_index"] = strconv.Itoa(int(metric.GetInstanceIndex()))
+		fields = append(fields,
+			"cpu_percentage="+formatFloat(metric.GetCpuPercentage()),
+			fmt.Sprintf("memory_bytes=%di", metric.GetMemoryBytes()),
+			fmt.Sprintf("disk_bytes=%di", metric.GetDiskBytes()),
+		)
+		if metric.MemoryBytesQuota != nil {
+			fields = append(fields, fmt.Sprintf("memory_bytes_quota=%di", metric.GetMemoryBytesQuota()))
+		}
+		if metric.DiskBytesQuota != nil {
+			fields = append(fields, fmt.Sprintf("disk_bytes_quota=%di", metric.GetDiskBytesQuota()))
+		}
+	default:
+		return nil
+	}
+
+	var names []string
+	for name, value := range tags {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	line := influxEscaper.Replace(measurement)
+	for _, name := range names {
+		line += "," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(tags[name])
+	}
+	line += " " + strings.Join(fields, ",") + " " + strconv.FormatInt(envelopeTime(envelope).UnixNano(), 10)
+	return []string{line}
+}
+
+func graphiteLines(envelope *events.Envelope) []string {
+	prefix := graphitePath(
+		graphiteSegment(envelope.GetDeployment()),
+		graphiteSegment(envelope.GetJob()),
+		graphiteSegment(envelope.GetIndex()),
+		graphiteSegment(envelope.GetOrigin()),
+	)
+	timestamp := strconv.FormatInt(envelopeTime(envelope).Unix(), 10)
+	line := func(name, value string) string {
+		return fmt.Sprintf("%s %s %s", graphitePath(prefix, name), value, timestamp)
+	}
+
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		metric := envelope.GetValueMetric()
+		return []string{line(graphiteName(metric.GetName()), formatFloat(metric.GetValue()))}
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		name := graphiteName(counter.GetName())
+		lines := []string{line(name+".delta", strconv.FormatUint(counter.GetDelta(), 10))}
+		if counter.Total != nil {
+			lines = append(lines, line(name+".total", strconv.FormatUint(counter.GetTotal(), 10)))
+		}
+		return lines
+	case events.Envelope_ContainerMetric:
+		metric := envelope.GetContainerMetric()
+		instance := graphitePath(graphiteSegment(metric.GetApplicationId()), strconv.Itoa(int(metric.GetInstanceIndex())))
+		lines := []string{
+			line(instance+".cpu_percentage", formatFloat(metric.GetCpuPercentage())),
+			line(instance+".memory_bytes", strconv.FormatUint(metric.GetMemoryBytes(), 10)),
+			line(instance+".disk_bytes", strconv.FormatUint(metric.GetDiskBytes(), 10)),
+		}
+		if metric.MemoryBytesQuota != nil {
+			lines = append(lines, line(instance+".memory_bytes_quota", strconv.FormatUint(metric.GetMemoryBytesQuota(), 10)))
+		}
+		if metric.DiskBytesQuota != nil {
+			lines = append(lines, line(instance+".disk_bytes_quota", strconv.FormatUint(metric.GetDiskBytesQuota(), 10)))
+		}
+		return lines
+	}
+	return nil
+}
+
+// graphitePath joins the non-empty segments of a metric path.
+func graphitePath(segments ...string) string {
+	var parts []string
+	for _, segment := range segments {
+		if segment != "" {
+			parts = append(parts, segment)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// graphiteName keeps the dots of a metric name as path separators and
+// replaces anything else Graphite would choke on.
+func graphiteName(name string) string {
+	segments := strings.Split(name, ".")
+	for i, segment := range segments {
+		segments[i] = graphiteSegment(segment)
+	}
+	return graphitePath(segments...)
+}
+
+func graphiteSegment(segment string) string {
+	return invalidGraphiteChars.ReplaceAllString(segment, "_")
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
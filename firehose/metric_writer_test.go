@@ -0,0 +1,162 @@
+package firehose
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("metricWriter", func() {
+	envelope := func(eventType events.Envelope_EventType) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("gorouter"),
+			EventType:  eventType.Enum(),
+			Timestamp:  proto.Int64(1500000000123456789),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("router"),
+			Index:      proto.String("0"),
+		}
+	}
+
+	valueMetric := func() *events.Envelope {
+		e := envelope(events.Envelope_ValueMetric)
+		e.Tags = map[string]string{"zone": "z 1"}
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("latency.ms"), Value: proto.Float64(12.5), Unit: proto.String("ms")}
+		return e
+	}
+
+	counterEvent := func() *events.Envelope {
+		e := envelope(events.Envelope_CounterEvent)
+		e.CounterEvent = &events.CounterEvent{Name: proto.String("requests"), Delta: proto.Uint64(2), Total: proto.Uint64(40)}
+		return e
+	}
+
+	containerMetric := func() *events.Envelope {
+		e := envelope(events.Envelope_ContainerMetric)
+		e.ContainerMetric = &events.ContainerMetric{
+			ApplicationId: proto.String("app-guid"),
+			InstanceIndex: proto.Int32(1),
+			CpuPercentage: proto.Float64(0.5),
+			MemoryBytes:   proto.Uint64(1024),
+			DiskBytes:     proto.Uint64(2048),
+		}
+		return e
+	}
+
+	It("rejects unknown formats and addresses", func() {
+		_, err := newMetricWriter("json", "")
+		Expect(err).To(MatchError("Unable to recognize output format json. Use influx or graphite"))
+		_, err = newMetricWriter("influx", "http://localhost:8086")
+		Expect(err).To(MatchError(ContainSubstring("Unable to parse output address http://localhost:8086")))
+	})
+
+	Describe("the influx line protocol", func() {
+		It("converts value metrics", func() {
+			Expect(influxLines(valueMetric())).To(Equal([]string{
+				`latency.ms,deployment=cf,index=0,job=router,origin=gorouter,unit=ms,zone=z\ 1 value=12.5 1500000000123456789`,
+			}))
+		})
+
+		It("converts counter events", func() {
+			Expect(influxLines(counterEvent())).To(Equal([]string{
+				`requests,deployment=cf,index=0,job=router,origin=gorouter delta=2i,total=40i 1500000000123456789`,
+			}))
+		})
+
+		It("leaves out the total of counter events without one", func() {
+			e := counterEvent()
+			e.CounterEvent.Total = nil
+			Expect(influxLines(e)).To(Equal([]string{
+				`requests,deployment=cf,index=0,job=router,origin=gorouter delta=2i 1500000000123456789`,
+			}))
+		})
+
+		It("converts container metrics", func() {
+			Expect(influxLines(containerMetric())).To(Equal([]string{
+				`container_metric,application_id=app-guid,deployment=cf,index=0,instance_index=1,job=router,origin=gorouter cpu_percentage=0.5,memory_bytes=1024i,disk_bytes=2048i 1500000000123456789`,
+			}))
+		})
+
+		It("ignores other event types", func() {
+			Expect(influxLines(envelope(events.Envelope_LogMessage))).To(BeEmpty())
+		})
+	})
+
+	Describe("the graphite plaintext protocol", func() {
+		It("converts value metrics", func() {
+			Expect(graphiteLines(valueMetric())).To(Equal([]string{"cf.router.0.gorouter.latency.ms 12.5 1500000000"}))
+		})
+
+		It("converts counter events", func() {
+			Expect(graphiteLines(counterEvent())).To(Equal([]string{
+				"cf.router.0.gorouter.requests.delta 2 1500000000",
+				"cf.router.0.gorouter.requests.total 40 1500000000",
+			}))
+		})
+
+		It("leaves out the total of counter events without one", func() {
+			e := counterEvent()
+			e.CounterEvent.Total = nil
+			Expect(graphiteLines(e)).To(Equal([]string{"cf.router.0.gorouter.requests.delta 2 1500000000"}))
+		})
+
+		It("converts container metrics", func() {
+			Expect(graphiteLines(containerMetric())).To(Equal([]string{
+				"cf.router.0.gorouter.app-guid.1.cpu_percentage 0.5 1500000000",
+				"cf.router.0.gorouter.app-guid.1.memory_bytes 1024 1500000000",
+				"cf.router.0.gorouter.app-guid.1.disk_bytes 2048 1500000000",
+			}))
+		})
+
+		It("sanitizes path segments", func() {
+			e := valueMetric()
+			e.Origin = proto.String("my origin")
+			e.ValueMetric.Name = proto.String("cpu/user..total")
+			Expect(graphiteLines(e)).To(Equal([]string{"cf.router.0.my_origin.cpu_user.total 12.5 1500000000"}))
+		})
+	})
+
+	It("writes to a TCP address", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		lines := make(chan string)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+
+		w, err := newMetricWriter("graphite", "tcp://"+listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Write(valueMetric())).To(Succeed())
+		Eventually(lines).Should(Receive(Equal("cf.router.0.gorouter.latency.ms 12.5 1500000000")))
+		Expect(w.Close()).To(Succeed())
+	})
+
+	It("writes a datagram per line to a UDP address", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		w, err := newMetricWriter("graphite", "udp://"+conn.LocalAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer w.Close()
+		Expect(w.Write(counterEvent())).To(Succeed())
+
+		buffer := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buffer[:n])).To(Equal("cf.router.0.gorouter.requests.delta 2 1500000000\n"))
+	})
+})
@@ -0,0 +1,152 @@
+package firehose
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const patternAppsShown = 3
+
+var (
+	uuidToken = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	ipToken   = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+	hexToken  = regexp.MustCompile(`\b(0x[0-9a-fA-F]+|[0-9a-fA-F]{8,})\b`)
+	numToken  = regexp.MustCompile(`-?\b\d+(\.\d+)?`)
+)
+
+// PatternCollector is a Sink that clusters log message bodies into
+// templates by masking the tokens that vary between otherwise identical
+// messages.
+type PatternCollector struct {
+	patterns map[string]*pattern
+	total    int
+}
+
+type pattern struct {
+	template string
+	example  string
+	count    int
+	apps     map[string]int
+}
+
+func NewPatternCollector() *PatternCollector {
+	return &PatternCollector{patterns: make(map[string]*pattern)}
+}
+
+func (p *PatternCollector) Write(envelope *events.Envelope) error {
+	if envelope.GetEventType() != events.Envelope_LogMessage {
+		return nil
+	}
+	logMessage := envelope.GetLogMessage()
+	message := strings.TrimSpace(string(logMessage.GetMessage()))
+	template := LogTemplate(message)
+
+	pat, ok := p.patterns[template]
+	if !ok {
+		pat = &pattern{template: template, example: message, apps: make(map[string]int)}
+		p.patterns[template] = pat
+	}
+	pat.count++
+	pat.apps[logMessage.GetAppId()]++
+	p.total++
+	return nil
+}
+
+func (p *PatternCollector) Close() error {
+	return nil
+}
+
+// Print shows the most frequent patterns with their share of all messages,
+// the apps emitting them and an example line.
+func (p *PatternCollector) Print(ui terminal.UI, top int) {
+	if p.total == 0 {
+		ui.Say("No log messages received")
+		return
+	}
+
+	patterns := make([]*pattern, 0, len(p.patterns))
+	for _, pat := range p.patterns {
+		patterns = append(patterns, pat)
+	}
+	sort.Sort(byPatternCount(patterns))
+	if top > 0 && len(patterns) > top {
+		patterns = patterns[:top]
+	}
+
+	ui.Say("Top %d of %s log patterns from %s messages:", len(patterns), formatCount(len(p.patterns)), formatCount(p.total))
+	for i, pat := range patterns {
+		ui.Say("")
+		ui.Say("%d. %s (%.1f%%)  %s", i+1, formatCount(pat.count), 100*float64(pat.count)/float64(p.total), pat.template)
+		ui.Say("   apps: %s", pat.appBreakdown())
+		ui.Say("   example: %s", pat.example)
+	}
+}
+
+func (pat *pattern) appBreakdown() string {
+	apps := make([]string, 0, len(pat.apps))
+	for app := range pat.apps {
+		apps = append(apps, app)
+	}
+	sort.Sort(byStringCount{apps, pat.apps})
+
+	var parts []string
+	for i, app := range apps {
+		if i == patternAppsShown {
+			parts = append(parts, fmt.Sprintf("%d others", len(apps)-patternAppsShown))
+			break
+		}
+		name := app
+		if name == "" {
+			name = "(no app)"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", name, formatCount(pat.apps[app])))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LogTemplate masks the variable tokens of a log message: UUIDs, IP
+// addresses, hex strings and numbers.
+func LogTemplate(message string) string {
+	message = uuidToken.ReplaceAllString(message, "<uuid>")
+	message = ipToken.ReplaceAllString(message, "<ip>")
+	message = hexToken.ReplaceAllStringFunc(message, func(token string) string {
+		if strings.HasPrefix(token, "0x") || strings.ContainsAny(token, "0123456789") {
+			return "<hex>"
+		}
+		return token
+	})
+	return numToken.ReplaceAllString(message, "<num>")
+}
+
+type byPatternCount []*pattern
+
+func (b byPatternCount) Len() int      { return len(b) }
+func (b byPatternCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPatternCount) Less(i, j int) bool {
+	if b[i].count != b[j].count {
+		return b[i].count > b[j].count
+	}
+	return b[i].template < b[j].template
+}
+
+// byStringCount sorts names by how often they were counted, most frequent
+// first, then by name.
+type byStringCount struct {
+	names  []string
+	counts map[string]int
+}
+
+func (b byStringCount) Len() int      { return len(b.names) }
+func (b byStringCount) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+func (b byStringCount) Less(i, j int) bool {
+	ci, cj := b.counts[b.names[i]], b.counts[b.names[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return b.names[i] < b.names[j]
+}
@@ -0,0 +1,57 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PatternCollector", func() {
+	logMessage := func(appID, message string) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message: []byte(message),
+				AppId:   proto.String(appID),
+			},
+		}
+	}
+
+	It("masks the variable tokens of a message", func() {
+		Expect(LogTemplate("request 6ba7b810-9dad-11d1-80b4-00c04fd430c8 took 12.5ms")).To(Equal("request <uuid> took <num>ms"))
+		Expect(LogTemplate("connect to 10.0.16.4:8080 failed")).To(Equal("connect to <ip> failed"))
+		Expect(LogTemplate("commit deadbeef42 at 0x1f")).To(Equal("commit <hex> at <hex>"))
+		Expect(LogTemplate("status=503 retries=-1")).To(Equal("status=<num> retries=<num>"))
+		Expect(LogTemplate("no variable parts in Application")).To(Equal("no variable parts in Application"))
+	})
+
+	It("counts messages per template and per app", func() {
+		p := NewPatternCollector()
+		Expect(p.Write(logMessage("app-a", "GET /users/1 200"))).To(Succeed())
+		Expect(p.Write(logMessage("app-a", "GET /users/2 200"))).To(Succeed())
+		Expect(p.Write(logMessage("app-b", "GET /users/3 404"))).To(Succeed())
+		Expect(p.Write(logMessage("app-b", "shutting down"))).To(Succeed())
+
+		Expect(p.total).To(Equal(4))
+		Expect(p.patterns).To(HaveLen(2))
+		pat := p.patterns["GET /users/<num> <num>"]
+		Expect(pat.count).To(Equal(3))
+		Expect(pat.example).To(Equal("GET /users/1 200"))
+		Expect(pat.appBreakdown()).To(Equal("app-a: 2, app-b: 1"))
+	})
+
+	It("ignores other event types", func() {
+		p := NewPatternCollector()
+		Expect(p.Write(&events.Envelope{EventType: events.Envelope_Error.Enum()})).To(Succeed())
+		Expect(p.total).To(Equal(0))
+	})
+
+	It("summarizes the apps beyond the first few", func() {
+		p := NewPatternCollector()
+		for _, app := range []string{"a", "a", "b", "c", "d", "e"} {
+			p.Write(logMessage(app, "crash"))
+		}
+		Expect(p.patterns["crash"].appBreakdown()).To(Equal("a: 2, b: 1, c: 1, 2 others"))
+	})
+})
@@ -0,0 +1,229 @@
+package firehose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const pickerSampleDuration = 5 * time.Second
+
+// pickFilter asks for the event types to display and, optionally, for the
+// origins and jobs among the ones seen in a short sample of the stream.
+// The choice is remembered as the last selection of the command.
+func (c *Client) pickFilter(ctx context.Context) (*envelopeFilter, error) {
+	last := c.lastSelection()
+	filter, reused, err := c.promptFilterType(ctx, last)
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		c.ui.Say("Displaying %s", filter.description())
+		return filter, nil
+	}
+
+	if err := c.promptSources(ctx, filter); err != nil {
+		return nil, err
+	}
+	c.rememberSelection(filter)
+	return filter, nil
+}
+
+func (c *Client) promptFilterType(ctx context.Context, last *envelopeFilter) (*envelopeFilter, bool, error) {
+	lastChoice := ""
+	if last != nil {
+		lastChoice = fmt.Sprintf("\n\t  l for the last selection: %s", last.description())
+	}
+
+	answer, err := c.ask(ctx, `Please enter one or more of the following choices, separated by commas:
+	  hit 'enter' for all messages`+lastChoice+`
+	  2 for HttpStart
+	  3 for HttpStop
+	  4 for HttpStartStop
+	  5 for LogMessage
+	  6 for ValueMetric
+	  7 for CounterEvent
+	  8 for Error
+	  9 for ContainerMetric
+	`)
+	if err != nil {
+		return nil, false, err
+	}
+
+	filter := newEnvelopeFilter()
+	if answer == "" {
+		return filter, false, nil
+	}
+	if last != nil && answer == "l" {
+		return last, true, nil
+	}
+
+	for _, choice := range splitChoices(answer) {
+		filterInt, err := strconv.Atoi(choice)
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid filter choice %s. Enter an index from 2-9", choice)
+		}
+
+		_, ok := events.Envelope_EventType_name[int32(filterInt)]
+		if !ok {
+			return nil, false, fmt.Errorf("Invalid filter choice %d", filterInt)
+		}
+		filter.types[events.Envelope_EventType(filterInt)] = true
+	}
+	return filter, false, nil
+}
+
+// promptSources offers to narrow the filter down to some of the origins
+// and jobs sending the selected event types.
+func (c *Client) promptSources(ctx context.Context, filter *envelopeFilter) error {
+	answer, err := c.ask(ctx, "Do you want to pick origins and jobs from a sample of the live stream? [y/N]")
+	if err != nil {
+		return err
+	}
+	if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return nil
+	}
+
+	c.ui.Say("Sampling the stream for %s...", pickerSampleDuration)
+	origins, jobs := c.sampleSources(ctx, filter, pickerSampleDuration)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(origins) == 0 && len(jobs) == 0 {
+		c.ui.Say("No messages received while sampling")
+		return nil
+	}
+
+	if filter.origins, err = c.pickFrom(ctx, "origin", "origins", origins); err != nil {
+		return err
+	}
+	filter.jobs, err = c.pickFrom(ctx, "job", "jobs", jobs)
+	return err
+}
+
+// sampleSources counts the origins and jobs of the envelopes of the
+// selected types received within the given time on a connection of its own.
+func (c *Client) sampleSources(ctx context.Context, filter *envelopeFilter, duration time.Duration) (map[string]int, map[string]int) {
+	origins := make(map[string]int)
+	jobs := make(map[string]int)
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	output, errors := c.nozzle(WithSubscriptionID(c.subscriptionID()+"-sample"), WithConnections(1)).Stream(ctx)
+	for envelope := range output {
+		if !filter.matchesType(envelope.GetEventType()) {
+			continue
+		}
+		if envelope.GetOrigin() != "" {
+			origins[envelope.GetOrigin()]++
+		}
+		if envelope.GetJob() != "" {
+			jobs[envelope.GetJob()]++
+		}
+	}
+	for err := range errors {
+		c.ui.Warn(err.Error())
+	}
+	return origins, jobs
+}
+
+// pickFrom lists the names seen while sampling, most frequent first, and
+// returns the ones chosen. Choosing none selects all of them.
+func (c *Client) pickFrom(ctx context.Context, kind, plural string, counts map[string]int) (map[string]bool, error) {
+	picked := make(map[string]bool)
+	if len(counts) == 0 {
+		return picked, nil
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Sort(byStringCount{names, counts})
+
+	c.ui.Say("")
+	c.ui.Say("The %s seen while sampling:", plural)
+	for i, name := range names {
+		c.ui.Say("  %d. %s (%s)", i+1, name, formatCount(counts[name]))
+	}
+	answer, err := c.ask(ctx, fmt.Sprintf("Enter the %s to display, separated by commas, or hit 'enter' for all", plural))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, choice := range splitChoices(answer) {
+		index, err := strconv.Atoi(choice)
+		if err != nil || index < 1 || index > len(names) {
+			return nil, fmt.Errorf("Invalid %s choice %s. Enter an index from 1-%d", kind, choice, len(names))
+		}
+		picked[names[index-1]] = true
+	}
+	return picked, nil
+}
+
+func splitChoices(answer string) []string {
+	return strings.FieldsFunc(answer, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// lastSelection returns the filter picked the last time the command ran,
+// if it is remembered.
+func (c *Client) lastSelection() *envelopeFilter {
+	selections := c.readSelections()
+	selection, ok := selections[c.options.SelectionKey]
+	if !ok {
+		return nil
+	}
+	filter, err := filterFromSelection(selection)
+	if err != nil {
+		return nil
+	}
+	return filter
+}
+
+func (c *Client) rememberSelection(filter *envelopeFilter) {
+	if c.options.SelectionFile == "" {
+		return
+	}
+	selections := c.readSelections()
+	if selections == nil {
+		selections = make(map[string]filterSelection)
+	}
+	selections[c.options.SelectionKey] = filter.selection()
+
+	data, err := json.MarshalIndent(selections, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.options.SelectionFile), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(c.options.SelectionFile, data, 0600)
+	}
+	if err != nil {
+		c.ui.Warn("Unable to remember the selection: %s", err)
+	}
+}
+
+func (c *Client) readSelections() map[string]filterSelection {
+	if c.options.SelectionFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.options.SelectionFile)
+	if err != nil {
+		return nil
+	}
+	var selections map[string]filterSelection
+	if err := json.Unmarshal(data, &selections); err != nil {
+		return nil
+	}
+	return selections
+}
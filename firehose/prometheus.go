@@ -0,0 +1,251 @@
+package firehose
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// prometheusStaleAfter is how long a series is exported after its last
+// update, so metrics of components that went away eventually disappear.
+const prometheusStaleAfter = 5 * time.Minute
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// PrometheusExporter is a Sink that serves the metrics it receives on
+// /metrics in the Prometheus text format: ValueMetrics as gauges,
+// CounterEvents as counters and ContainerMetrics as per-instance gauges.
+// Counter names end in _total, and ValueMetrics whose names do too get a
+// _value suffix so that no name is exported with both types.
+type PrometheusExporter struct {
+	listener net.Listener
+	now      func() time.Time
+
+	lock   sync.Mutex
+	series map[string]*promSeries
+}
+
+type promSeries struct {
+	name      string
+	kind      string
+	help      string
+	labels    string
+	value     float64
+	updatedAt time.Time
+}
+
+// NewPrometheusExporter starts serving /metrics on the given address such
+// as :9191.
+func NewPrometheusExporter(address string) (*PrometheusExporter, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to serve Prometheus metrics on %s: %s", address, err)
+	}
+	p := newPrometheusExporter()
+	p.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	go http.Serve(listener, mux)
+	return p, nil
+}
+
+func newPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{
+		now:    time.Now,
+		series: make(map[string]*promSeries),
+	}
+}
+
+// Address returns the address the exporter listens on.
+func (p *PrometheusExporter) Address() string {
+	return p.listener.Addr().String()
+}
+
+func (p *PrometheusExporter) Write(envelope *events.Envelope) error {
+	labels := envelopeLabels(envelope)
+
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		metric := envelope.GetValueMetric()
+		help := fmt.Sprintf("ValueMetric %s", metric.GetName())
+		if metric.GetUnit() != "" {
+			help += fmt.Sprintf(" (%s)", metric.GetUnit())
+		}
+		p.set(gaugeName(metric.GetName()), "gauge", help, labels, metric.GetValue())
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		name := metricName(counter.GetName()) + "_total"
+		help := fmt.Sprintf("CounterEvent %s", counter.GetName())
+		if counter.Total != nil {
+			p.set(name, "counter", help, labels, float64(counter.GetTotal()))
+		} else {
+			p.add(name, "counter", help, labels, float64(counter.GetDelta()))
+		}
+	case events.Envelope_ContainerMetric:
+		metric := envelope.GetContainerMetric()
+		labels = append(labels,
+			label{"application_id", metric.GetApplicationId()},
+			label{"instance_index", strconv.Itoa(int(metric.GetInstanceIndex()))},
+		)
+		p.set("container_cpu_percentage", "gauge", "ContainerMetric CPU usage in percent", labels, metric.GetCpuPercentage())
+		p.set("container_memory_bytes", "gauge", "ContainerMetric memory usage in bytes", labels, float64(metric.GetMemoryBytes()))
+		p.set("container_disk_bytes", "gauge", "ContainerMetric disk usage in bytes", labels, float64(metric.GetDiskBytes()))
+		if metric.MemoryBytesQuota != nil {
+			p.set("container_memory_bytes_quota", "gauge", "ContainerMetric memory quota in bytes", labels, float64(metric.GetMemoryBytesQuota()))
+		}
+		if metric.DiskBytesQuota != nil {
+			p.set("container_disk_bytes_quota", "gauge", "ContainerMetric disk quota in bytes", labels, float64(metric.GetDiskBytesQuota()))
+		}
+	}
+	return nil
+}
+
+func (p *PrometheusExporter) Close() error {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Close()
+}
+
+func (p *PrometheusExporter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(p.exposition())
+}
+
+func (p *PrometheusExporter) set(name, kind, help string, labels []label, value float64) {
+	p.update(name, kind, help, labels, func(s *promSeries) { s.value = value })
+}
+
+func (p *PrometheusExporter) add(name, kind, help string, labels []label, delta float64) {
+	p.update(name, kind, help, labels, func(s *promSeries) { s.value += delta })
+}
+
+func (p *PrometheusExporter) update(name, kind, help string, labels []label, apply func(*promSeries)) {
+	formatted := formatLabels(labels)
+	key := name + formatted
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.series[key]
+	if !ok {
+		s = &promSeries{name: name, kind: kind, help: help, labels: formatted}
+		p.series[key] = s
+	}
+	apply(s)
+	s.updatedAt = p.now()
+}
+
+// exposition renders the series in the Prometheus text format, expiring the
+// stale ones first.
+func (p *PrometheusExporter) exposition() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cutoff := p.now().Add(-prometheusStaleAfter)
+	var series []*promSeries
+	for key, s := range p.series {
+		if s.updatedAt.Before(cutoff) {
+			delete(p.series, key)
+			continue
+		}
+		series = append(series, s)
+	}
+	// Sorting on the name first keeps all the series of a metric together,
+	// as Prometheus expects them under a single HELP and TYPE.
+	sort.Sort(bySeries(series))
+
+	var out bytes.Buffer
+	lastName := ""
+	for _, s := range series {
+		if s.name != lastName {
+			fmt.Fprintf(&out, "# HELP %s %s\n", s.name, s.help)
+			fmt.Fprintf(&out, "# TYPE %s %s\n", s.name, s.kind)
+			lastName = s.name
+		}
+		fmt.Fprintf(&out, "%s%s %s\n", s.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	return out.Bytes()
+}
+
+type bySeries []*promSeries
+
+func (b bySeries) Len() int      { return len(b) }
+func (b bySeries) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bySeries) Less(i, j int) bool {
+	if b[i].name != b[j].name {
+		return b[i].name < b[j].name
+	}
+	return b[i].labels < b[j].labels
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type byLabelName []label
+
+func (b byLabelName) Len() int           { return len(b) }
+func (b byLabelName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLabelName) Less(i, j int) bool { return b[i].name < b[j].name }
+
+func envelopeLabels(envelope *events.Envelope) []label {
+	labels := []label{
+		{"origin", envelope.GetOrigin()},
+		{"deployment", envelope.GetDeployment()},
+		{"job", envelope.GetJob()},
+		{"index", envelope.GetIndex()},
+	}
+	for name, value := range envelope.GetTags() {
+		labels = append(labels, label{metricName(name), value})
+	}
+	return labels
+}
+
+func formatLabels(labels []label) string {
+	sorted := make([]label, 0, len(labels))
+	for _, l := range labels {
+		if l.value != "" {
+			sorted = append(sorted, l)
+		}
+	}
+	if len(sorted) == 0 {
+		return ""
+	}
+	sort.Sort(byLabelName(sorted))
+
+	parts := make([]string, len(sorted))
+	for i, l := range sorted {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", l.name, labelEscaper.Replace(l.value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// gaugeName keeps ValueMetric names clear of the _total suffix of counters.
+func gaugeName(name string) string {
+	name = metricName(name)
+	if strings.HasSuffix(name, "_total") {
+		name += "_value"
+	}
+	return name
+}
+
+func metricName(name string) string {
+	name = invalidMetricChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,132 @@
+package firehose
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusExporter", func() {
+	var (
+		p   *PrometheusExporter
+		now time.Time
+	)
+
+	envelope := func(eventType events.Envelope_EventType) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("gorouter"),
+			EventType:  eventType.Enum(),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("router"),
+			Index:      proto.String("0"),
+		}
+	}
+
+	scrape := func() string {
+		request, err := http.NewRequest("GET", "/metrics", nil)
+		Expect(err).NotTo(HaveOccurred())
+		recorder := httptest.NewRecorder()
+		p.ServeHTTP(recorder, request)
+		Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		return recorder.Body.String()
+	}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		p = newPrometheusExporter()
+		p.now = func() time.Time { return now }
+	})
+
+	It("exports value metrics as gauges", func() {
+		e := envelope(events.Envelope_ValueMetric)
+		e.Tags = map[string]string{"source-id": "router \"z1\""}
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("latency.ms"), Value: proto.Float64(12.5), Unit: proto.String("ms")}
+		Expect(p.Write(e)).To(Succeed())
+
+		Expect(scrape()).To(Equal(`# HELP latency_ms ValueMetric latency.ms (ms)
+# TYPE latency_ms gauge
+latency_ms{deployment="cf",index="0",job="router",origin="gorouter",source_id="router \"z1\""} 12.5
+`))
+	})
+
+	It("exports counter events as counters", func() {
+		e := envelope(events.Envelope_CounterEvent)
+		e.CounterEvent = &events.CounterEvent{Name: proto.String("requests"), Delta: proto.Uint64(2)}
+		p.Write(e)
+		p.Write(e)
+		Expect(scrape()).To(ContainSubstring("# TYPE requests_total counter\nrequests_total{deployment=\"cf\",index=\"0\",job=\"router\",origin=\"gorouter\"} 4\n"))
+
+		e.CounterEvent.Total = proto.Uint64(100)
+		p.Write(e)
+		Expect(scrape()).To(ContainSubstring("} 100\n"))
+	})
+
+	It("groups the series of each metric under one HELP and TYPE", func() {
+		for _, series := range []struct{ name, origin string }{{"a", ""}, {"a_b", "x"}, {"a", "x"}} {
+			e := envelope(events.Envelope_ValueMetric)
+			e.Origin, e.Deployment, e.Job, e.Index = proto.String(series.origin), nil, nil, nil
+			e.ValueMetric = &events.ValueMetric{Name: proto.String(series.name), Value: proto.Float64(1)}
+			p.Write(e)
+		}
+
+		Expect(scrape()).To(Equal(`# HELP a ValueMetric a
+# TYPE a gauge
+a 1
+a{origin="x"} 1
+# HELP a_b ValueMetric a_b
+# TYPE a_b gauge
+a_b{origin="x"} 1
+`))
+	})
+
+	It("does not export gauges under counter names", func() {
+		gauge := envelope(events.Envelope_ValueMetric)
+		gauge.ValueMetric = &events.ValueMetric{Name: proto.String("requests_total"), Value: proto.Float64(7)}
+		p.Write(gauge)
+		counter := envelope(events.Envelope_CounterEvent)
+		counter.CounterEvent = &events.CounterEvent{Name: proto.String("requests"), Delta: proto.Uint64(2)}
+		p.Write(counter)
+
+		output := scrape()
+		Expect(output).To(ContainSubstring("# TYPE requests_total counter\n"))
+		Expect(output).To(ContainSubstring("# TYPE requests_total_value gauge\n"))
+		Expect(output).ToNot(ContainSubstring("# TYPE requests_total gauge"))
+	})
+
+	It("exports container metrics per instance", func() {
+		e := envelope(events.Envelope_ContainerMetric)
+		e.ContainerMetric = &events.ContainerMetric{
+			ApplicationId: proto.String("app-guid"),
+			InstanceIndex: proto.Int32(3),
+			CpuPercentage: proto.Float64(0.5),
+			MemoryBytes:   proto.Uint64(1024),
+			DiskBytes:     proto.Uint64(2048),
+		}
+		p.Write(e)
+		output := scrape()
+		Expect(output).To(ContainSubstring(`container_cpu_percentage{application_id="app-guid",deployment="cf",index="0",instance_index="3",job="router",origin="gorouter"} 0.5`))
+		Expect(output).To(ContainSubstring(`container_memory_bytes{application_id="app-guid",`))
+		Expect(output).To(ContainSubstring(`} 2048`))
+		Expect(output).ToNot(ContainSubstring("quota"))
+	})
+
+	It("ignores other event types", func() {
+		p.Write(envelope(events.Envelope_LogMessage))
+		Expect(scrape()).To(BeEmpty())
+	})
+
+	It("expires stale series", func() {
+		e := envelope(events.Envelope_ValueMetric)
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("1st"), Value: proto.Float64(1)}
+		p.Write(e)
+		Expect(scrape()).To(ContainSubstring("_1st{"))
+
+		now = now.Add(prometheusStaleAfter + time.Second)
+		Expect(scrape()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,256 @@
+package firehose
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// proxyClientBuffer is how many envelopes a proxy client may fall behind
+// before envelopes are dropped for it.
+const proxyClientBuffer = 1000
+
+// noaaOrigin is the Origin header noaa consumers send whatever they connect
+// to.
+const noaaOrigin = "http://localhost"
+
+// Proxy is a Sink that re-serves the envelopes of a single firehose
+// connection to local websocket clients on the paths doppler uses:
+// /firehose/{subscription-id} and /apps/{app-guid}/stream. Clients sharing
+// a subscription ID split the envelopes between them as they would on
+// doppler.
+type Proxy struct {
+	listener net.Listener
+	upgrader websocket.Upgrader
+
+	lock    sync.Mutex
+	groups  map[string]*proxyGroup
+	apps    map[*proxyClient]string
+	dropped int
+	closed  bool
+}
+
+type proxyGroup struct {
+	clients []*proxyClient
+	next    int
+}
+
+type proxyClient struct {
+	conn     *websocket.Conn
+	messages chan []byte
+}
+
+// NewProxy starts accepting websocket clients on the given address such as
+// 127.0.0.1:8081.
+func NewProxy(address string) (*Proxy, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s: %s", address, err)
+	}
+	p := &Proxy{
+		listener: listener,
+		upgrader: websocket.Upgrader{CheckOrigin: checkOrigin},
+		groups:   make(map[string]*proxyGroup),
+		apps:     make(map[*proxyClient]string),
+	}
+	go http.Serve(listener, p)
+	return p, nil
+}
+
+// checkOrigin accepts the clients gorilla accepts by default, those sending
+// no Origin or one on the proxy's own host, and noaa consumers. Browsers on
+// other sites are rejected so that no web page can read the firehose.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == noaaOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Address returns the address the proxy listens on.
+func (p *Proxy) Address() string {
+	return p.listener.Addr().String()
+}
+
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var subscriptionID, appGUID string
+	switch {
+	case len(parts) == 2 && parts[0] == "firehose" && parts[1] != "":
+		subscriptionID = parts[1]
+	case len(parts) == 3 && parts[0] == "apps" && parts[1] != "" && parts[2] == "stream":
+		appGUID = parts[1]
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	conn, err := p.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	client := &proxyClient{conn: conn, messages: make(chan []byte, proxyClientBuffer)}
+	if !p.add(client, subscriptionID, appGUID) {
+		conn.Close()
+		return
+	}
+
+	go client.send()
+	// Reading is only needed to notice the client going away.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			p.remove(client)
+			return
+		}
+	}
+}
+
+// Write hands the envelope to one client of every subscription and to the
+// streams of the app it belongs to.
+func (p *Proxy) Write(envelope *events.Envelope) error {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	appGUID := envelopeAppGUID(envelope)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, group := range p.groups {
+		group.next = (group.next + 1) % len(group.clients)
+		p.deliver(group.clients[group.next], data)
+	}
+	if appGUID != "" {
+		for client, guid := range p.apps {
+			if guid == appGUID {
+				p.deliver(client, data)
+			}
+		}
+	}
+	return nil
+}
+
+// Close disconnects the clients and stops listening.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for _, group := range p.groups {
+		for _, client := range group.clients {
+			close(client.messages)
+		}
+	}
+	for client := range p.apps {
+		close(client.messages)
+	}
+	p.groups = make(map[string]*proxyGroup)
+	p.apps = make(map[*proxyClient]string)
+	return p.listener.Close()
+}
+
+// Dropped returns how many envelopes were not delivered because a client
+// fell too far behind.
+func (p *Proxy) Dropped() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.dropped
+}
+
+func (p *Proxy) clientCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	count := len(p.apps)
+	for _, group := range p.groups {
+		count += len(group.clients)
+	}
+	return count
+}
+
+func (p *Proxy) deliver(client *proxyClient, data []byte) {
+	select {
+	case client.messages <- data:
+	default:
+		p.dropped++
+	}
+}
+
+func (p *Proxy) add(client *proxyClient, subscriptionID, appGUID string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return false
+	}
+	if appGUID != "" {
+		p.apps[client] = appGUID
+		return true
+	}
+	group, ok := p.groups[subscriptionID]
+	if !ok {
+		group = &proxyGroup{}
+		p.groups[subscriptionID] = group
+	}
+	group.clients = append(group.clients, client)
+	return true
+}
+
+func (p *Proxy) remove(client *proxyClient) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.apps[client]; ok {
+		delete(p.apps, client)
+		close(client.messages)
+		return
+	}
+	for id, group := range p.groups {
+		for i, c := range group.clients {
+			if c != client {
+				continue
+			}
+			group.clients = append(group.clients[:i], group.clients[i+1:]...)
+			if len(group.clients) == 0 {
+				delete(p.groups, id)
+			}
+			close(client.messages)
+			return
+		}
+	}
+}
+
+// send writes the envelopes to the client until it is removed, then closes
+// the connection normally.
+func (c *proxyClient) send() {
+	defer c.conn.Close()
+	for data := range c.messages {
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			c.conn.Close()
+			for range c.messages {
+			}
+			return
+		}
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+func envelopeAppGUID(envelope *events.Envelope) string {
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		return envelope.GetLogMessage().GetAppId()
+	case events.Envelope_ContainerMetric:
+		return envelope.GetContainerMetric().GetApplicationId()
+	case events.Envelope_HttpStartStop:
+		if id := envelope.GetHttpStartStop().GetApplicationId(); id != nil {
+			return uuidString(id)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package firehose
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy", func() {
+	var (
+		p   *Proxy
+		url string
+	)
+
+	logMessage := func(appID, message string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String("origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:     []byte(message),
+				MessageType: events.LogMessage_OUT.Enum(),
+				Timestamp:   proto.Int64(1),
+				AppId:       proto.String(appID),
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		p, err = NewProxy("127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		url = "ws://" + p.Address()
+	})
+
+	AfterEach(func() {
+		p.Close()
+	})
+
+	It("re-serves envelopes to firehose clients", func() {
+		cnsmr := consumer.New(url, &tls.Config{}, nil)
+		defer cnsmr.Close()
+		output, _ := cnsmr.FirehoseWithoutReconnect("local", "any-token")
+		Eventually(p.clientCount).Should(Equal(1))
+
+		Expect(p.Write(logMessage("app-guid", "hello"))).To(Succeed())
+		var envelope *events.Envelope
+		Eventually(output).Should(Receive(&envelope))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal("hello"))
+	})
+
+	It("splits the envelopes between clients sharing a subscription", func() {
+		first := consumer.New(url, &tls.Config{}, nil)
+		defer first.Close()
+		second := consumer.New(url, &tls.Config{}, nil)
+		defer second.Close()
+		firstOutput, _ := first.FirehoseWithoutReconnect("shared", "")
+		secondOutput, _ := second.FirehoseWithoutReconnect("shared", "")
+		Eventually(p.clientCount).Should(Equal(2))
+
+		p.Write(logMessage("app-guid", "one"))
+		p.Write(logMessage("app-guid", "two"))
+		Eventually(firstOutput).Should(Receive())
+		Eventually(secondOutput).Should(Receive())
+		Consistently(firstOutput, "100ms").ShouldNot(Receive())
+		Consistently(secondOutput, "100ms").ShouldNot(Receive())
+	})
+
+	It("streams only the envelopes of the requested app", func() {
+		cnsmr := consumer.New(url, &tls.Config{}, nil)
+		defer cnsmr.Close()
+		output, _ := cnsmr.StreamWithoutReconnect("app-guid", "")
+		Eventually(p.clientCount).Should(Equal(1))
+
+		p.Write(logMessage("other-app", "skipped"))
+		p.Write(logMessage("app-guid", "kept"))
+		var envelope *events.Envelope
+		Eventually(output).Should(Receive(&envelope))
+		Expect(string(envelope.GetLogMessage().GetMessage())).To(Equal("kept"))
+	})
+
+	It("forgets clients that disconnect", func() {
+		cnsmr := consumer.New(url, &tls.Config{}, nil)
+		cnsmr.FirehoseWithoutReconnect("local", "")
+		Eventually(p.clientCount).Should(Equal(1))
+		cnsmr.Close()
+		Eventually(p.clientCount).Should(Equal(0))
+	})
+
+	It("closes the client connections normally", func() {
+		cnsmr := consumer.New(url, &tls.Config{}, nil)
+		defer cnsmr.Close()
+		output, errs := cnsmr.FirehoseWithoutReconnect("local", "")
+		Eventually(p.clientCount).Should(Equal(1))
+
+		p.Close()
+		Eventually(output).Should(BeClosed())
+		Eventually(errs).Should(Receive(MatchError(ContainSubstring("close 1000"))))
+	})
+
+	It("rejects browsers connecting from other sites", func() {
+		header := http.Header{"Origin": []string{"http://example.com"}}
+		_, response, err := websocket.DefaultDialer.Dial(url+"/firehose/local", header)
+		Expect(err).To(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(p.clientCount()).To(Equal(0))
+	})
+
+	It("rejects other paths", func() {
+		response, err := http.Get("http://" + p.Address() + "/recent")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
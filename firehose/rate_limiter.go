@@ -0,0 +1,140 @@
+package firehose
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const suppressionReportInterval = 5 * time.Second
+
+// rateLimiter caps the number of envelopes written to the output per second
+// using a token bucket, and keeps count of what it suppressed.
+type rateLimiter struct {
+	now func() time.Time
+
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+
+	suppressed map[events.Envelope_EventType]int
+	lastReport time.Time
+	total      int
+}
+
+func newRateLimiter(maxRate string) (*rateLimiter, error) {
+	r := &rateLimiter{
+		now:        time.Now,
+		suppressed: make(map[events.Envelope_EventType]int),
+	}
+	if maxRate == "" {
+		return r, nil
+	}
+
+	rate, err := strconv.Atoi(strings.TrimSuffix(maxRate, "/s"))
+	if err != nil || rate < 1 {
+		return nil, fmt.Errorf("Unable to parse rate %s. Use a number of messages per second such as 100/s", maxRate)
+	}
+	r.rate = float64(rate)
+	r.tokens = r.rate
+	r.lastRefill = r.now()
+	r.lastReport = r.lastRefill
+	return r, nil
+}
+
+func (r *rateLimiter) enabled() bool {
+	return r.rate > 0
+}
+
+func (r *rateLimiter) description() string {
+	return fmt.Sprintf("%s/s", formatCount(int(r.rate)))
+}
+
+func (r *rateLimiter) allow(envelope *events.Envelope) bool {
+	if !r.enabled() {
+		return true
+	}
+
+	now := r.now()
+	r.tokens += now.Sub(r.lastRefill).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.lastRefill = now
+
+	if r.tokens < 1 {
+		r.suppressed[envelope.GetEventType()]++
+		r.total++
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// report describes the envelopes suppressed since the last report and
+// resets the counts. It returns false if nothing was suppressed.
+func (r *rateLimiter) report() (string, bool) {
+	now := r.now()
+	interval := now.Sub(r.lastReport)
+	r.lastReport = now
+
+	var count int
+	for _, suppressed := range r.suppressed {
+		count += suppressed
+	}
+	if count == 0 {
+		return "", false
+	}
+
+	eventTypes := make([]events.Envelope_EventType, 0, len(r.suppressed))
+	for eventType := range r.suppressed {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Sort(byCount{eventTypes, r.suppressed})
+
+	breakdown := make([]string, len(eventTypes))
+	for i, eventType := range eventTypes {
+		breakdown[i] = fmt.Sprintf("%s: %s", eventType, formatCount(r.suppressed[eventType]))
+	}
+	r.suppressed = make(map[events.Envelope_EventType]int)
+
+	return fmt.Sprintf("... %s envelopes suppressed in last %s (%s)", formatCount(count), roundInterval(interval), strings.Join(breakdown, ", ")), true
+}
+
+func roundInterval(interval time.Duration) time.Duration {
+	if interval < time.Second {
+		return interval / time.Millisecond * time.Millisecond
+	}
+	return (interval + time.Second/2) / time.Second * time.Second
+}
+
+type byCount struct {
+	eventTypes []events.Envelope_EventType
+	counts     map[events.Envelope_EventType]int
+}
+
+func (b byCount) Len() int      { return len(b.eventTypes) }
+func (b byCount) Swap(i, j int) { b.eventTypes[i], b.eventTypes[j] = b.eventTypes[j], b.eventTypes[i] }
+func (b byCount) Less(i, j int) bool {
+	ci, cj := b.counts[b.eventTypes[i]], b.counts[b.eventTypes[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return b.eventTypes[i] < b.eventTypes[j]
+}
+
+// formatCount renders a count with thousands separators, such as 12,345.
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	digits := strconv.Itoa(n)
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
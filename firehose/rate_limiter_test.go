@@ -0,0 +1,95 @@
+package firehose
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rateLimiter", func() {
+	var (
+		now     time.Time
+		limiter *rateLimiter
+	)
+
+	envelope := func(eventType events.Envelope_EventType) *events.Envelope {
+		return &events.Envelope{EventType: eventType.Enum()}
+	}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		var err error
+		limiter, err = newRateLimiter("2/s")
+		Expect(err).ToNot(HaveOccurred())
+		limiter.now = func() time.Time { return now }
+		limiter.lastRefill = now
+		limiter.lastReport = now
+	})
+
+	It("allows everything when no rate is given", func() {
+		unlimited, err := newRateLimiter("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unlimited.enabled()).To(BeFalse())
+		for i := 0; i < 1000; i++ {
+			Expect(unlimited.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		}
+	})
+
+	It("rejects invalid rates", func() {
+		for _, rate := range []string{"fast", "0/s", "-1/s", "10/m"} {
+			_, err := newRateLimiter(rate)
+			Expect(err).To(MatchError("Unable to parse rate " + rate + ". Use a number of messages per second such as 100/s"))
+		}
+	})
+
+	It("accepts a rate without unit", func() {
+		limiter, err := newRateLimiter("100")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(limiter.description()).To(Equal("100/s"))
+	})
+
+	It("caps the messages per second and refills over time", func() {
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeFalse())
+
+		now = now.Add(500 * time.Millisecond)
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeFalse())
+
+		now = now.Add(10 * time.Second)
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeTrue())
+		Expect(limiter.allow(envelope(events.Envelope_LogMessage))).To(BeFalse())
+		Expect(limiter.total).To(Equal(3))
+	})
+
+	It("reports the suppressed messages by type since the last report", func() {
+		limiter.tokens = 0
+		for i := 0; i < 12000; i++ {
+			limiter.allow(envelope(events.Envelope_LogMessage))
+		}
+		for i := 0; i < 345; i++ {
+			limiter.allow(envelope(events.Envelope_ValueMetric))
+		}
+
+		now = now.Add(5 * time.Second)
+		report, ok := limiter.report()
+		Expect(ok).To(BeTrue())
+		Expect(report).To(Equal("... 12,345 envelopes suppressed in last 5s (LogMessage: 12,000, ValueMetric: 345)"))
+
+		now = now.Add(5 * time.Second)
+		_, ok = limiter.report()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("formats counts with thousands separators", func() {
+		Expect(formatCount(0)).To(Equal("0"))
+		Expect(formatCount(999)).To(Equal("999"))
+		Expect(formatCount(1000)).To(Equal("1,000"))
+		Expect(formatCount(1234567)).To(Equal("1,234,567"))
+		Expect(formatCount(-12345)).To(Equal("-12,345"))
+	})
+})
@@ -0,0 +1,132 @@
+package firehose
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	ringDumpTimeFormat = "20060102-150405.000000000"
+
+	// ringTriggerInterval is how long a matching message has to wait after
+	// the last dump before it dumps the ring again.
+	ringTriggerInterval = 10 * time.Second
+)
+
+// ring keeps the last envelopes received, before any filtering, so they
+// can be dumped to a file for context when something interesting happens.
+type ring struct {
+	lock      sync.Mutex
+	envelopes []*events.Envelope
+	next      int
+	full      bool
+
+	// dumped, lastDump and sinceDump rate-limit the dumps a trigger asks
+	// for, so a pattern matching often does not flood the disk.
+	dumped    bool
+	lastDump  time.Time
+	sinceDump int
+
+	trigger *regexp.Regexp
+	dir     string
+	now     func() time.Time
+}
+
+func newRing(size int, trigger, dir string) (*ring, error) {
+	r := &ring{dir: dir, now: time.Now}
+	if size > 0 {
+		r.envelopes = make([]*events.Envelope, size)
+	}
+	if trigger != "" {
+		pattern, err := regexp.Compile(trigger)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse pattern %s: %s", trigger, err.Error())
+		}
+		r.trigger = pattern
+	}
+	if r.dir == "" {
+		r.dir = "."
+	}
+	return r, nil
+}
+
+func (r *ring) enabled() bool {
+	return len(r.envelopes) > 0
+}
+
+func (r *ring) push(envelope *events.Envelope) {
+	if !r.enabled() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.envelopes[r.next] = envelope
+	r.sinceDump++
+	r.next++
+	if r.next == len(r.envelopes) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// triggered reports whether a displayed envelope matches the pattern that
+// dumps the ring. After a dump, matches are ignored until the ring has been
+// filled with new envelopes and ringTriggerInterval has passed.
+func (r *ring) triggered(envelope *events.Envelope) bool {
+	if !r.enabled() || r.trigger == nil || !r.trigger.MatchString(envelope.String()) {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.dumped {
+		return true
+	}
+	return r.sinceDump >= len(r.envelopes) && r.now().Sub(r.lastDump) >= ringTriggerInterval
+}
+
+// contents returns the envelopes in the ring, oldest first.
+func (r *ring) contents() []*events.Envelope {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]*events.Envelope(nil), r.envelopes[:r.next]...)
+	}
+	return append(append([]*events.Envelope(nil), r.envelopes[r.next:]...), r.envelopes[:r.next]...)
+}
+
+// dump writes the envelopes in the ring to a new file named after the
+// current time and returns its path and the number of envelopes written.
+func (r *ring) dump() (string, int, error) {
+	envelopes := r.contents()
+	now := r.now()
+	r.lock.Lock()
+	r.dumped = true
+	r.lastDump = now
+	r.sinceDump = 0
+	r.lock.Unlock()
+	path := filepath.Join(r.dir, fmt.Sprintf("nozzle-ring-%s.log", now.Format(ringDumpTimeFormat)))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", 0, fmt.Errorf("Unable to dump the ring buffer: %s", err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, envelope := range envelopes {
+		fmt.Fprintf(writer, "%v\n", envelope)
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("Unable to dump the ring buffer: %s", err)
+	}
+	return path, len(envelopes), nil
+}
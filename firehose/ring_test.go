@@ -0,0 +1,120 @@
+package firehose
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ring", func() {
+	logMessage := func(message string) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("rep"),
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{Message: []byte(message)},
+		}
+	}
+
+	messages := func(envelopes []*events.Envelope) []string {
+		var bodies []string
+		for _, envelope := range envelopes {
+			bodies = append(bodies, string(envelope.GetLogMessage().GetMessage()))
+		}
+		return bodies
+	}
+
+	It("is disabled without a size", func() {
+		r, err := newRing(0, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.enabled()).To(BeFalse())
+		r.push(logMessage("one"))
+		Expect(r.contents()).To(BeEmpty())
+	})
+
+	It("keeps the last envelopes, oldest first", func() {
+		r, err := newRing(3, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		r.push(logMessage("one"))
+		r.push(logMessage("two"))
+		Expect(messages(r.contents())).To(Equal([]string{"one", "two"}))
+
+		r.push(logMessage("three"))
+		r.push(logMessage("four"))
+		r.push(logMessage("five"))
+		Expect(messages(r.contents())).To(Equal([]string{"three", "four", "five"}))
+	})
+
+	It("is triggered by envelopes matching the pattern", func() {
+		r, err := newRing(3, "Exit status [1-9]", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.triggered(logMessage("Exit status 0"))).To(BeFalse())
+		Expect(r.triggered(logMessage("Exit status 137"))).To(BeTrue())
+	})
+
+	It("is not triggered again until the ring is refilled and some time has passed", func() {
+		dir, err := ioutil.TempDir("", "nozzle-ring")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		now := time.Date(2017, 7, 14, 10, 2, 3, 4, time.UTC)
+		r, err := newRing(2, "Exit status [1-9]", dir)
+		Expect(err).NotTo(HaveOccurred())
+		r.now = func() time.Time { return now }
+		crash := logMessage("Exit status 1")
+
+		r.push(crash)
+		Expect(r.triggered(crash)).To(BeTrue())
+		_, _, err = r.dump()
+		Expect(err).NotTo(HaveOccurred())
+
+		r.push(crash)
+		r.push(crash)
+		Expect(r.triggered(crash)).To(BeFalse())
+
+		now = now.Add(ringTriggerInterval)
+		Expect(r.triggered(crash)).To(BeTrue())
+		_, _, err = r.dump()
+		Expect(err).NotTo(HaveOccurred())
+
+		now = now.Add(ringTriggerInterval)
+		r.push(crash)
+		Expect(r.triggered(crash)).To(BeFalse())
+	})
+
+	It("rejects an invalid pattern", func() {
+		_, err := newRing(3, "(", "")
+		Expect(err).To(MatchError(ContainSubstring("Unable to parse pattern (")))
+	})
+
+	It("dumps the envelopes into a file named after the time", func() {
+		dir, err := ioutil.TempDir("", "nozzle-ring")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		r, err := newRing(2, "", dir)
+		Expect(err).NotTo(HaveOccurred())
+		r.now = func() time.Time { return time.Date(2017, 7, 14, 10, 2, 3, 4, time.UTC) }
+		r.push(logMessage("one"))
+		r.push(logMessage("two"))
+		r.push(logMessage("three"))
+
+		path, count, err := r.dump()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(dir, "nozzle-ring-20170714-100203.000000004.log")))
+		Expect(count).To(Equal(2))
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(ContainSubstring(`message:"two"`))
+		Expect(lines[1]).To(ContainSubstring(`message:"three"`))
+	})
+})
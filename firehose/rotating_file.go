@@ -0,0 +1,267 @@
+package firehose
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	defaultOutputFileMaxSize = 100 * 1024 * 1024
+	defaultOutputFileKeep    = 10
+	rotatedFileTimeFormat    = "20060102-150405.000000000"
+	// outputFileRetryInterval is how long the file keeps growing after a
+	// failed rotation before the next attempt.
+	outputFileRetryInterval = time.Minute
+)
+
+var byteSizePattern = regexp.MustCompile(`^(\d+)\s*([KMG]?)B?$`)
+
+// rotatingFile is a Sink that writes the messages to a file like the
+// terminal would, rotating it once it grows past a size or gets older than
+// an interval. Rotated files are compressed with gzip in the background and
+// only the most recent ones are kept. When a rotation fails, the messages
+// keep going to the current file.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+	now      func() time.Time
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	retryAt time.Time
+
+	// compressed is closed once the last rotated file is compressed, and
+	// compressErr tells why that failed until Write or Close reports it.
+	compressed  chan struct{}
+	lock        sync.Mutex
+	compressErr error
+}
+
+func newRotatingFile(path, maxSize string, interval time.Duration, keep int) (*rotatingFile, error) {
+	size := int64(defaultOutputFileMaxSize)
+	if maxSize != "" {
+		var err error
+		if size, err = parseByteSize(maxSize); err != nil {
+			return nil, err
+		}
+	}
+	if keep < 1 {
+		keep = defaultOutputFileKeep
+	}
+
+	f := &rotatingFile{path: path, maxSize: size, interval: interval, keep: keep, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(envelope *events.Envelope) error {
+	line := fmt.Sprintf("%v\n", envelope)
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	failure := f.takeCompressErr()
+	if f.due(len(line)) {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return err
+			}
+			failure = err
+		}
+	}
+	n, err := io.WriteString(f.file, line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return failure
+}
+
+func (f *rotatingFile) Close() error {
+	if f.compressed != nil {
+		<-f.compressed
+	}
+	failure := f.takeCompressErr()
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+	}
+	return failure
+}
+
+func (f *rotatingFile) due(length int) bool {
+	if f.now().Before(f.retryAt) {
+		return false
+	}
+	if f.size > 0 && f.size+int64(length) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && f.now().Sub(f.opened) >= f.interval
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open output file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to open output file: %s", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.now()
+	return nil
+}
+
+// rotate moves the current file aside and starts a new one, then
+// compresses the moved file and removes the oldest rotated files beyond the
+// ones to keep in the background, so that a large file does not hold up the
+// stream. It waits for the previous compression to finish first. When the
+// file cannot be moved, it is reopened to keep appending to it.
+func (f *rotatingFile) rotate() error {
+	if f.compressed != nil {
+		<-f.compressed
+	}
+	if err := f.file.Close(); err != nil {
+		return f.resume(fmt.Errorf("Unable to rotate output file: %s", err))
+	}
+	rotated := f.rotatedName()
+	if err := os.Rename(f.path, rotated); err != nil {
+		return f.resume(fmt.Errorf("Unable to rotate output file: %s", err))
+	}
+	f.compressed = make(chan struct{})
+	go f.compress(rotated, f.compressed)
+	return f.open()
+}
+
+// resume reopens the current file after a failed rotation and puts off the
+// next attempt.
+func (f *rotatingFile) resume(err error) error {
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+	}
+	f.retryAt = f.now().Add(outputFileRetryInterval)
+	return err
+}
+
+func (f *rotatingFile) compress(rotated string, done chan struct{}) {
+	defer close(done)
+	var err error
+	if err = compressFile(rotated, rotated+".gz"); err != nil {
+		err = fmt.Errorf("Unable to compress output file %s: %s", rotated, err)
+	} else if err = os.Remove(rotated); err != nil {
+		err = fmt.Errorf("Unable to compress output file %s: %s", rotated, err)
+	} else if err = f.prune(); err != nil {
+		err = fmt.Errorf("Unable to remove old output files: %s", err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.compressErr = err
+}
+
+func (f *rotatingFile) takeCompressErr() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.compressErr
+	f.compressErr = nil
+	return err
+}
+
+// rotatedName names the rotated file before compression, which adds .gz.
+func (f *rotatingFile) rotatedName() string {
+	base := f.path + "." + f.now().Format(rotatedFileTimeFormat)
+	name := base
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = base + "-" + strconv.Itoa(i)
+	}
+	return name
+}
+
+func (f *rotatingFile) prune() error {
+	rotated, err := filepath.Glob(f.path + ".*.gz")
+	if err != nil {
+		return err
+	}
+	// The timestamps in the names sort chronologically.
+	sort.Strings(rotated)
+	for len(rotated) > f.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func compressFile(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Leave no partial archive behind; the source is still there.
+		os.Remove(destination)
+	}
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// parseByteSize parses sizes such as 512KB, 100MB or 1GB.
+func parseByteSize(size string) (int64, error) {
+	match := byteSizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("Unable to parse size %s. Use a size such as 100MB", size)
+	}
+	value, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || value < 1 {
+		return 0, fmt.Errorf("Unable to parse size %s. Use a size such as 100MB", size)
+	}
+	switch match[2] {
+	case "K":
+		value *= 1024
+	case "M":
+		value *= 1024 * 1024
+	case "G":
+		value *= 1024 * 1024 * 1024
+	}
+	return value, nil
+}
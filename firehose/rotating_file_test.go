@@ -0,0 +1,177 @@
+package firehose
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rotatingFile", func() {
+	var (
+		dir  string
+		path string
+		now  time.Time
+	)
+
+	logMessage := func(message string) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("rep"),
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{Message: []byte(message)},
+		}
+	}
+
+	rotated := func() []string {
+		files, err := filepath.Glob(path + ".*.gz")
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	decompress := func(name string) string {
+		file, err := os.Open(name)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := ioutil.ReadAll(reader)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	open := func(maxSize string, interval time.Duration, keep int) *rotatingFile {
+		f, err := newRotatingFile(path, maxSize, interval, keep)
+		Expect(err).NotTo(HaveOccurred())
+		f.now = func() time.Time { return now }
+		f.opened = now
+		return f
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nozzle-output")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "nozzle.log")
+		now = time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("parses sizes", func() {
+		Expect(parseByteSize("512")).To(Equal(int64(512)))
+		Expect(parseByteSize("4KB")).To(Equal(int64(4096)))
+		Expect(parseByteSize("100mb")).To(Equal(int64(100 * 1024 * 1024)))
+		Expect(parseByteSize("1G")).To(Equal(int64(1024 * 1024 * 1024)))
+		_, err := parseByteSize("lots")
+		Expect(err).To(MatchError("Unable to parse size lots. Use a size such as 100MB"))
+	})
+
+	It("writes the messages as displayed and appends to an existing file", func() {
+		Expect(ioutil.WriteFile(path, []byte("earlier\n"), 0644)).To(Succeed())
+		f := open("", 0, 0)
+		Expect(f.Write(logMessage("hello"))).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(HavePrefix("earlier\n"))
+		Expect(string(data)).To(ContainSubstring(`logMessage:<message:"hello"`))
+		Expect(rotated()).To(BeEmpty())
+	})
+
+	It("rotates and compresses the file once it reaches the maximum size", func() {
+		f := open("100", 0, 0)
+		Expect(f.Write(logMessage("first"))).To(Succeed())
+		now = now.Add(time.Second)
+		Expect(f.Write(logMessage("second"))).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(rotated()).To(Equal([]string{path + ".20170714-024001.000000000.gz"}))
+		Expect(decompress(rotated()[0])).To(ContainSubstring("first"))
+		data, _ := ioutil.ReadFile(path)
+		Expect(string(data)).To(ContainSubstring("second"))
+		Expect(string(data)).ToNot(ContainSubstring("first"))
+	})
+
+	It("rotates the file after the interval", func() {
+		f := open("", time.Hour, 0)
+		f.Write(logMessage("first"))
+		now = now.Add(30 * time.Minute)
+		f.Write(logMessage("second"))
+		Expect(rotated()).To(BeEmpty())
+
+		now = now.Add(30 * time.Minute)
+		f.Write(logMessage("third"))
+		f.Close()
+		Expect(rotated()).To(HaveLen(1))
+		Expect(decompress(rotated()[0])).To(ContainSubstring("second"))
+	})
+
+	It("keeps only the most recent rotated files", func() {
+		f := open("1", 0, 2)
+		for _, message := range []string{"one", "two", "three", "four"} {
+			now = now.Add(time.Second)
+			Expect(f.Write(logMessage(message))).To(Succeed())
+		}
+		f.Close()
+
+		files := rotated()
+		Expect(files).To(HaveLen(2))
+		Expect(decompress(files[0])).To(ContainSubstring("two"))
+		Expect(decompress(files[1])).To(ContainSubstring("three"))
+	})
+
+	It("keeps writing to the current file when a rotation fails", func() {
+		f := open("100", 0, 0)
+		Expect(f.Write(logMessage("first"))).To(Succeed())
+		Expect(os.Remove(path)).To(Succeed())
+		now = now.Add(time.Second)
+		Expect(f.Write(logMessage("second"))).To(MatchError(ContainSubstring("Unable to rotate output file")))
+		Expect(f.Write(logMessage("third"))).To(Succeed())
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("second"))
+		Expect(string(data)).To(ContainSubstring("third"))
+		Expect(rotated()).To(BeEmpty())
+
+		now = now.Add(outputFileRetryInterval)
+		Expect(f.Write(logMessage("fourth"))).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+		Expect(rotated()).To(HaveLen(1))
+		Expect(decompress(rotated()[0])).To(ContainSubstring("third"))
+	})
+
+	It("recovers once the file can be opened again", func() {
+		f := open("100", 0, 0)
+		Expect(f.Write(logMessage("first"))).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+		now = now.Add(time.Second)
+		Expect(f.Write(logMessage("second"))).To(HaveOccurred())
+
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(f.Write(logMessage("third"))).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("third"))
+	})
+
+	It("leaves no partial archive when compression fails", func() {
+		Expect(compressFile(dir, path+".gz")).NotTo(Succeed())
+		Expect(fileExists(path + ".gz")).To(BeFalse())
+	})
+
+	It("reports files it cannot open", func() {
+		_, err := newRotatingFile(filepath.Join(dir, "missing", "nozzle.log"), "", 0, 0)
+		Expect(err).To(MatchError(ContainSubstring("Unable to open output file")))
+	})
+})
@@ -0,0 +1,158 @@
+package firehose
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const samplingWindow = time.Second
+
+var sampleKeyFields = map[string]func(*events.Envelope) string{
+	"origin":     (*events.Envelope).GetOrigin,
+	"deployment": (*events.Envelope).GetDeployment,
+	"job":        (*events.Envelope).GetJob,
+	"index":      (*events.Envelope).GetIndex,
+	"ip":         (*events.Envelope).GetIp,
+	"eventType": func(envelope *events.Envelope) string {
+		return envelope.GetEventType().String()
+	},
+}
+
+// sampler thins out the displayed envelopes, either uniformly, by keeping a
+// reservoir of envelopes per key for every sampling window, or both.
+type sampler struct {
+	random *rand.Rand
+
+	rate        string
+	probability float64
+
+	keys          []string
+	reservoirSize int
+	reservoirs    map[string]*reservoir
+
+	considered int
+	kept       int
+}
+
+type reservoir struct {
+	seen      int
+	envelopes []*events.Envelope
+}
+
+func newSampler(rate, keys string, reservoirSize int) (*sampler, error) {
+	s := &sampler{
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		probability:   1,
+		reservoirSize: reservoirSize,
+		reservoirs:    make(map[string]*reservoir),
+	}
+
+	if rate != "" {
+		parts := strings.Split(rate, "/")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Unable to parse sample rate %s. Use a fraction such as 1/100", rate)
+		}
+		numerator, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse sample rate %s. Use a fraction such as 1/100", rate)
+		}
+		denominator, err := strconv.Atoi(parts[1])
+		if err != nil || numerator < 1 || denominator < numerator {
+			return nil, fmt.Errorf("Unable to parse sample rate %s. Use a fraction such as 1/100", rate)
+		}
+		s.rate = rate
+		s.probability = float64(numerator) / float64(denominator)
+	}
+
+	if keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			key = strings.TrimSpace(key)
+			if _, ok := sampleKeyFields[key]; !ok {
+				return nil, fmt.Errorf("Unable to recognize sample key %s", key)
+			}
+			s.keys = append(s.keys, key)
+		}
+		if s.reservoirSize < 1 {
+			s.reservoirSize = 1
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sampler) enabled() bool {
+	return s.rate != "" || len(s.keys) > 0
+}
+
+func (s *sampler) perKey() bool {
+	return len(s.keys) > 0
+}
+
+func (s *sampler) description() string {
+	var parts []string
+	if s.rate != "" {
+		parts = append(parts, fmt.Sprintf("%s of all messages", s.rate))
+	}
+	if s.perKey() {
+		parts = append(parts, fmt.Sprintf("up to %d messages per %s every %s", s.reservoirSize, strings.Join(s.keys, ","), samplingWindow))
+	}
+	return strings.Join(parts, ", then ")
+}
+
+// sample returns the envelopes to display right away. Envelopes sampled per
+// key are held back until the next flush.
+func (s *sampler) sample(envelope *events.Envelope) []*events.Envelope {
+	s.considered++
+	if s.probability < 1 && s.random.Float64() >= s.probability {
+		return nil
+	}
+	if !s.perKey() {
+		s.kept++
+		return []*events.Envelope{envelope}
+	}
+
+	key := s.key(envelope)
+	r, ok := s.reservoirs[key]
+	if !ok {
+		r = &reservoir{}
+		s.reservoirs[key] = r
+	}
+	r.seen++
+	if len(r.envelopes) < s.reservoirSize {
+		r.envelopes = append(r.envelopes, envelope)
+	} else if i := s.random.Intn(r.seen); i < s.reservoirSize {
+		r.envelopes[i] = envelope
+	}
+	return nil
+}
+
+// flush empties the reservoirs at the end of a sampling window.
+func (s *sampler) flush() []*events.Envelope {
+	keys := make([]string, 0, len(s.reservoirs))
+	for key := range s.reservoirs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var envelopes []*events.Envelope
+	for _, key := range keys {
+		envelopes = append(envelopes, s.reservoirs[key].envelopes...)
+	}
+	s.reservoirs = make(map[string]*reservoir)
+	s.kept += len(envelopes)
+	return envelopes
+}
+
+func (s *sampler) key(envelope *events.Envelope) string {
+	values := make([]string, len(s.keys))
+	for i, key := range s.keys {
+		values[i] = sampleKeyFields[key](envelope)
+	}
+	return strings.Join(values, "/")
+}
@@ -0,0 +1,68 @@
+package firehose
+
+import (
+	"math/rand"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sampler", func() {
+	envelope := func(origin, job string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String(origin),
+			Job:       proto.String(job),
+			EventType: events.Envelope_ValueMetric.Enum(),
+		}
+	}
+
+	It("is disabled by default", func() {
+		s, err := newSampler("", "", 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.enabled()).To(BeFalse())
+		Expect(s.sample(envelope("a", "b"))).To(HaveLen(1))
+	})
+
+	It("rejects rates that are not a fraction", func() {
+		for _, rate := range []string{"100", "a/b", "0/10", "2/1", "1/2/3"} {
+			_, err := newSampler(rate, "", 0)
+			Expect(err).To(MatchError("Unable to parse sample rate " + rate + ". Use a fraction such as 1/100"))
+		}
+	})
+
+	It("rejects unknown keys", func() {
+		_, err := newSampler("", "origin,colour", 0)
+		Expect(err).To(MatchError("Unable to recognize sample key colour"))
+	})
+
+	It("keeps roughly the requested share of messages", func() {
+		s, _ := newSampler("1/10", "", 0)
+		s.random = rand.New(rand.NewSource(42))
+		for i := 0; i < 10000; i++ {
+			s.sample(envelope("a", "b"))
+		}
+		Expect(s.considered).To(Equal(10000))
+		Expect(s.kept).To(BeNumerically("~", 1000, 100))
+		Expect(s.description()).To(Equal("1/10 of all messages"))
+	})
+
+	It("keeps a reservoir per key until flushed", func() {
+		s, _ := newSampler("", "origin, job", 2)
+		for i := 0; i < 5; i++ {
+			Expect(s.sample(envelope("router", "router_z1"))).To(BeEmpty())
+			Expect(s.sample(envelope("doppler", "doppler_z1"))).To(BeEmpty())
+		}
+		Expect(s.sample(envelope("doppler", "doppler_z2"))).To(BeEmpty())
+
+		flushed := s.flush()
+		Expect(flushed).To(HaveLen(5))
+		Expect(flushed[0].GetJob()).To(Equal("doppler_z1"))
+		Expect(flushed[2].GetJob()).To(Equal("doppler_z2"))
+		Expect(flushed[3].GetJob()).To(Equal("router_z1"))
+		Expect(s.kept).To(Equal(5))
+		Expect(s.flush()).To(BeEmpty())
+		Expect(s.description()).To(Equal("up to 2 messages per origin,job every 1s"))
+	})
+})
@@ -0,0 +1,115 @@
+package firehose
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// session holds the state of a single run of the nozzle, from the buffer
+// behind the connection to the summary printed at the end.
+type session struct {
+	filter     *envelopeFilter
+	tracer     *tracer
+	stitcher   *stitcher
+	conditions *stopConditions
+	buffer     *envelopeBuffer
+	deduper    *deduper
+	sampler    *sampler
+	limiter    *rateLimiter
+	ring       *ring
+	sinks      []Sink
+	summary    *sessionSummary
+}
+
+func newSession(options *ClientOptions, filter *envelopeFilter) (*session, error) {
+	// The exporter sits behind the display stages, which would leave the
+	// series it serves stale.
+	if options.Prometheus != "" && (options.MaxRate != "" || options.Sample != "" || options.SamplePerKey != "" || options.Dedupe > 0) {
+		return nil, errors.New("Unable to export Prometheus metrics with --max-rate, --sample, --sample-per-key or --dedupe, which drop updates")
+	}
+
+	tracer, err := newTracer(options.Trace)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions, err := newStopConditions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, err := newEnvelopeBuffer(options.BufferSize, options.BufferPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler, err := newSampler(options.Sample, options.SamplePerKey, options.SampleReservoir)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := newRateLimiter(options.MaxRate)
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := newRing(options.Ring, options.RingTrigger, options.RingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		filter:     filter,
+		tracer:     tracer,
+		stitcher:   newStitcher(options.Stitch),
+		conditions: conditions,
+		buffer:     buffer,
+		deduper:    newDeduper(options.Dedupe, options.DedupeNormalize),
+		sampler:    sampler,
+		limiter:    limiter,
+		ring:       ring,
+		summary:    newSessionSummary(),
+	}, nil
+}
+
+func (s *session) filtered(envelope *events.Envelope) bool {
+	if !s.filter.matchesSource(envelope) {
+		return false
+	}
+	if !s.filter.matchesType(envelope.GetEventType()) && !s.stitchable(envelope) {
+		return false
+	}
+	return s.tracer.traced(envelope)
+}
+
+// stitchable lets both halves of a request through a filter on any of the
+// HTTP event types, since the stitcher needs them to build a record.
+func (s *session) stitchable(envelope *events.Envelope) bool {
+	if !s.stitcher.enabled() {
+		return false
+	}
+	switch envelope.GetEventType() {
+	case events.Envelope_HttpStart, events.Envelope_HttpStop:
+	default:
+		return false
+	}
+	return s.filter.types[events.Envelope_HttpStart] || s.filter.types[events.Envelope_HttpStop] || s.filter.types[events.Envelope_HttpStartStop]
+}
+
+// finish records the counts of the pipeline stages in the summary.
+func (s *session) finish() {
+	s.summary.envelopesDropped(s.buffer.droppedCount())
+	if s.deduper.enabled() {
+		s.summary.envelopesCollapsed(s.deduper.collapsed)
+	}
+	if s.sampler.enabled() {
+		s.summary.envelopesSampled(s.sampler.description(), s.sampler.considered, s.sampler.kept)
+	}
+	if s.stitcher.enabled() {
+		s.summary.requestsStitched(s.stitcher.stitched, s.stitcher.orphans)
+	}
+	if s.limiter.enabled() {
+		s.summary.envelopesSuppressed(s.limiter.description(), s.limiter.total)
+	}
+}
@@ -0,0 +1,154 @@
+package firehose
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type sessionSummary struct {
+	lock sync.Mutex
+
+	started            time.Time
+	received           map[events.Envelope_EventType]int
+	displayed          map[events.Envelope_EventType]int
+	errors             int
+	slowConsumerAlerts int
+	dropped            int
+
+	deduplicated bool
+	collapsed    int
+
+	stitching bool
+	stitched  int
+	orphans   int
+
+	rateLimit  string
+	suppressed int
+
+	sampling         string
+	sampleConsidered int
+	sampleKept       int
+}
+
+func newSessionSummary() *sessionSummary {
+	return &sessionSummary{
+		started:   time.Now(),
+		received:  make(map[events.Envelope_EventType]int),
+		displayed: make(map[events.Envelope_EventType]int),
+	}
+}
+
+func (s *sessionSummary) envelopeReceived(envelope *events.Envelope) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received[envelope.GetEventType()]++
+}
+
+func (s *sessionSummary) envelopeDisplayed(envelope *events.Envelope) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.displayed[envelope.GetEventType()]++
+}
+
+func (s *sessionSummary) envelopesDropped(count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropped += count
+}
+
+func (s *sessionSummary) envelopesSampled(description string, considered, kept int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sampling = description
+	s.sampleConsidered = considered
+	s.sampleKept = kept
+}
+
+func (s *sessionSummary) envelopesCollapsed(count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deduplicated = true
+	s.collapsed = count
+}
+
+func (s *sessionSummary) requestsStitched(stitched, orphans int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stitching = true
+	s.stitched = stitched
+	s.orphans = orphans
+}
+
+func (s *sessionSummary) envelopesSuppressed(rateLimit string, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rateLimit = rateLimit
+	s.suppressed = count
+}
+
+func (s *sessionSummary) errorSeen() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors++
+}
+
+// slowConsumerAlertSeen counts the alert and reports whether it is the
+// first one of the session.
+func (s *sessionSummary) slowConsumerAlertSeen() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.slowConsumerAlerts++
+	return s.slowConsumerAlerts == 1
+}
+
+func (s *sessionSummary) print(ui terminal.UI) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ui.Say("Session summary:")
+	ui.Say("  duration: %.1fs", time.Since(s.started).Seconds())
+
+	var eventTypes []int
+	for eventType := range s.received {
+		eventTypes = append(eventTypes, int(eventType))
+	}
+	// Stitched requests are displayed as HttpStartStop events that were
+	// never received as such.
+	for eventType := range s.displayed {
+		if _, ok := s.received[eventType]; !ok {
+			eventTypes = append(eventTypes, int(eventType))
+		}
+	}
+	sort.Ints(eventTypes)
+	for _, eventType := range eventTypes {
+		eventType := events.Envelope_EventType(eventType)
+		ui.Say("  %s: %d received, %d displayed", eventType, s.received[eventType], s.displayed[eventType])
+	}
+
+	ui.Say("  dropped by buffer: %d", s.dropped)
+	if s.deduplicated {
+		ui.Say("  collapsed as duplicates: %d", s.collapsed)
+	}
+	if s.sampling != "" {
+		rate := 0.0
+		if s.sampleConsidered > 0 {
+			rate = 100 * float64(s.sampleKept) / float64(s.sampleConsidered)
+		}
+		ui.Say("  sampling %s: kept %d of %d messages (%.1f%%)", s.sampling, s.sampleKept, s.sampleConsidered, rate)
+	}
+	if s.stitching {
+		ui.Say("  stitched requests: %d, orphaned events: %d", s.stitched, s.orphans)
+	}
+	if s.rateLimit != "" {
+		ui.Say("  suppressed by rate limit of %s: %d", s.rateLimit, s.suppressed)
+	}
+	ui.Say("  errors: %d", s.errors)
+	ui.Say("  slow consumer alerts: %d", s.slowConsumerAlerts)
+	if s.slowConsumerAlerts > 0 {
+		ui.Warn("Doppler dropped messages during this session, so the output above is incomplete.")
+	}
+}
@@ -0,0 +1,117 @@
+package firehose
+
+import (
+	"crypto/tls"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Sink receives every envelope the nozzle displays, in addition to or
+// instead of the terminal. Sinks are closed when the session ends so they
+// can flush what they buffered.
+type Sink interface {
+	Write(envelope *events.Envelope) error
+	Close() error
+}
+
+// AddSink registers a sink for the envelopes of the next session.
+func (c *Client) AddSink(sink Sink) {
+	c.sinks = append(c.sinks, sink)
+}
+
+// openSinks opens the sinks configured in the options, next to the ones
+// registered with AddSink.
+func (c *Client) openSinks() ([]Sink, error) {
+	var opened []Sink
+	fail := func(err error) ([]Sink, error) {
+		for _, sink := range opened {
+			sink.Close()
+		}
+		return nil, err
+	}
+
+	if c.options.Prometheus != "" {
+		exporter, err := NewPrometheusExporter(c.options.Prometheus)
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Serving Prometheus metrics on http://%s/metrics", exporter.Address())
+		opened = append(opened, exporter)
+	}
+
+	if c.options.Output != "" {
+		writer, err := newMetricWriter(c.options.Output, c.options.OutputAddress)
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, writer)
+	}
+
+	if c.options.Statsd != "" {
+		statsd, err := newStatsdSink(c.options.Statsd, c.options.StatsdTemplate, c.options.StatsdSanitize)
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Sending metrics to statsd at %s", c.options.Statsd)
+		opened = append(opened, statsd)
+	}
+
+	if c.options.Syslog != "" {
+		syslog, err := newSyslogSink(c.options.Syslog, &tls.Config{})
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Forwarding log messages to syslog at %s", c.options.Syslog)
+		opened = append(opened, syslog)
+	}
+
+	if c.options.ServeSSE != "" {
+		server, err := newSSEServer(c.options.ServeSSE)
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Serving events on http://%s/events", server.listener.Addr())
+		opened = append(opened, server)
+	}
+
+	if c.options.OutputFile != "" {
+		file, err := newRotatingFile(c.options.OutputFile, c.options.OutputFileMaxSize, c.options.OutputFileRotate, c.options.OutputFileKeep)
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Writing messages to %s", c.options.OutputFile)
+		opened = append(opened, file)
+	}
+
+	if c.options.Store != "" {
+		store, err := newCaptureStore(c.options.Store)
+		if err != nil {
+			return fail(err)
+		}
+		c.ui.Say("Storing messages in %s", c.options.Store)
+		opened = append(opened, store)
+	}
+
+	return append(append([]Sink(nil), c.sinks...), opened...), nil
+}
+
+func (c *Client) writeToSinks(envelope *events.Envelope, session *session) {
+	for _, sink := range session.sinks {
+		if err := sink.Write(envelope); err != nil {
+			session.summary.errorSeen()
+			c.ui.Warn(err.Error())
+		}
+	}
+}
+
+func (c *Client) closeSinks(session *session) {
+	for _, sink := range session.sinks {
+		if err := sink.Close(); err != nil {
+			session.summary.errorSeen()
+			c.ui.Warn(err.Error())
+		}
+		if server, ok := sink.(*sseServer); ok && server.droppedCount() > 0 {
+			c.ui.Warn("Dropped %d messages for event stream clients that fell behind", server.droppedCount())
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package firehose
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
+)
+
+const slowConsumerHint = "Hint: the nozzle is not keeping up with the firehose. Use --filter to reduce the volume " +
+	"or share the load by running more nozzles with the same --subscription-id."
+
+const truncatingBufferLogPrefix = "Log message output is too high."
+
+// slowConsumerAlert recognizes the envelopes doppler inserts into a
+// subscriber's stream when it had to drop messages for it.
+func slowConsumerAlert(envelope *events.Envelope) (string, bool) {
+	switch envelope.GetEventType() {
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		switch counter.GetName() {
+		case "doppler_proxy.slow_consumer":
+			return fmt.Sprintf("%s reported a slow consumer", envelope.GetOrigin()), true
+		case "TruncatingBuffer.DroppedMessages", "TruncatingBuffer.totalDroppedMessages":
+			return fmt.Sprintf("%s dropped %d messages", envelope.GetOrigin(), counter.GetDelta()), true
+		}
+	case events.Envelope_LogMessage:
+		message := string(envelope.GetLogMessage().GetMessage())
+		if strings.HasPrefix(message, truncatingBufferLogPrefix) {
+			return message, true
+		}
+	}
+	return "", false
+}
+
+// slowConsumerDisconnect recognizes the close codes doppler uses when it
+// drops a subscriber that is not keeping up.
+func slowConsumerDisconnect(err error) (string, bool) {
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.ClosePolicyViolation {
+		return "", false
+	}
+	return fmt.Sprintf("doppler closed the connection: %s", closeErr.Text), true
+}
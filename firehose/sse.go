@@ -0,0 +1,345 @@
+package firehose
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// sseClientBuffer is how many events a browser may fall behind before
+// events are dropped for it.
+const sseClientBuffer = 1000
+
+// sseServer is a Sink that streams the envelopes as JSON Server-Sent Events
+// on /events. Every connection can narrow the stream with the type, origin
+// and app query parameters.
+type sseServer struct {
+	listener net.Listener
+
+	lock    sync.Mutex
+	clients map[*sseClient]struct{}
+	closed  bool
+	dropped int
+}
+
+type sseClient struct {
+	eventTypes map[events.Envelope_EventType]bool
+	origins    map[string]bool
+	appGUID    string
+	messages   chan []byte
+}
+
+func newSSEServer(address string) (*sseServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to serve events on %s: %s", address, err)
+	}
+	s := &sseServer{
+		listener: listener,
+		clients:  make(map[*sseClient]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/events", s)
+	go http.Serve(listener, mux)
+	return s, nil
+}
+
+func (s *sseServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	client, err := newSSEClient(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if !s.add(client) {
+		http.Error(rw, "The nozzle is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.remove(client)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	gone := r.Context().Done()
+	for {
+		select {
+		case data, ok := <-client.messages:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(rw, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-gone:
+			return
+		}
+	}
+}
+
+func newSSEClient(r *http.Request) (*sseClient, error) {
+	query := r.URL.Query()
+	client := &sseClient{
+		appGUID:  query.Get("app"),
+		messages: make(chan []byte, sseClientBuffer),
+	}
+	if types := query.Get("type"); types != "" {
+		client.eventTypes = make(map[events.Envelope_EventType]bool)
+		for _, name := range strings.Split(types, ",") {
+			eventType, ok := events.Envelope_EventType_value[name]
+			if !ok {
+				return nil, fmt.Errorf("Unable to recognize event type %s", name)
+			}
+			client.eventTypes[events.Envelope_EventType(eventType)] = true
+		}
+	}
+	if origins := query.Get("origin"); origins != "" {
+		client.origins = make(map[string]bool)
+		for _, origin := range strings.Split(origins, ",") {
+			client.origins[origin] = true
+		}
+	}
+	return client, nil
+}
+
+func (c *sseClient) wants(envelope *events.Envelope) bool {
+	if c.eventTypes != nil && !c.eventTypes[envelope.GetEventType()] {
+		return false
+	}
+	if c.origins != nil && !c.origins[envelope.GetOrigin()] {
+		return false
+	}
+	return c.appGUID == "" || c.appGUID == envelopeAppGUID(envelope)
+}
+
+func (s *sseServer) Write(envelope *events.Envelope) error {
+	var data []byte
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for client := range s.clients {
+		if !client.wants(envelope) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = envelopeJSON(envelope); err != nil {
+				return err
+			}
+		}
+		select {
+		case client.messages <- data:
+		default:
+			s.dropped++
+		}
+	}
+	return nil
+}
+
+func (s *sseServer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for client := range s.clients {
+		close(client.messages)
+	}
+	s.clients = make(map[*sseClient]struct{})
+	return s.listener.Close()
+}
+
+func (s *sseServer) add(client *sseClient) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.clients[client] = struct{}{}
+	return true
+}
+
+func (s *sseServer) remove(client *sseClient) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.clients[client]; ok {
+		delete(s.clients, client)
+		close(client.messages)
+	}
+}
+
+// droppedCount returns how many events were not delivered because a client
+// fell too far behind.
+func (s *sseServer) droppedCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+func (s *sseServer) clientCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
+type jsonEnvelope struct {
+	Origin          string                  `json:"origin"`
+	EventType       string                  `json:"eventType"`
+	Timestamp       int64                   `json:"timestamp"`
+	Deployment      string                  `json:"deployment,omitempty"`
+	Job             string                  `json:"job,omitempty"`
+	Index           string                  `json:"index,omitempty"`
+	IP              string                  `json:"ip,omitempty"`
+	Tags            map[string]string       `json:"tags,omitempty"`
+	HttpStart       *jsonHttpStart          `json:"httpStart,omitempty"`
+	HttpStop        *jsonHttpStop           `json:"httpStop,omitempty"`
+	HttpStartStop   *jsonHttpStartStop      `json:"httpStartStop,omitempty"`
+	LogMessage      *jsonLogMessage         `json:"logMessage,omitempty"`
+	ValueMetric     *events.ValueMetric     `json:"valueMetric,omitempty"`
+	CounterEvent    *events.CounterEvent    `json:"counterEvent,omitempty"`
+	Error           *events.Error           `json:"error,omitempty"`
+	ContainerMetric *events.ContainerMetric `json:"containerMetric,omitempty"`
+}
+
+// jsonLogMessage spells out the message and its type, which would otherwise
+// be encoded as base64 and a number.
+type jsonLogMessage struct {
+	Message        string `json:"message"`
+	MessageType    string `json:"messageType"`
+	Timestamp      int64  `json:"timestamp"`
+	AppID          string `json:"appId,omitempty"`
+	SourceType     string `json:"sourceType,omitempty"`
+	SourceInstance string `json:"sourceInstance,omitempty"`
+}
+
+// jsonHttpStart, jsonHttpStop and jsonHttpStartStop spell out request and
+// application IDs as UUIDs and the peer types and methods by name, so that
+// clients can correlate requests.
+type jsonHttpStart struct {
+	Timestamp       int64  `json:"timestamp"`
+	RequestID       string `json:"requestId,omitempty"`
+	PeerType        string `json:"peerType"`
+	Method          string `json:"method"`
+	URI             string `json:"uri"`
+	RemoteAddress   string `json:"remoteAddress,omitempty"`
+	UserAgent       string `json:"userAgent,omitempty"`
+	ParentRequestID string `json:"parentRequestId,omitempty"`
+	ApplicationID   string `json:"applicationId,omitempty"`
+	InstanceIndex   int32  `json:"instanceIndex,omitempty"`
+	InstanceID      string `json:"instanceId,omitempty"`
+}
+
+type jsonHttpStop struct {
+	Timestamp     int64  `json:"timestamp"`
+	URI           string `json:"uri"`
+	RequestID     string `json:"requestId,omitempty"`
+	PeerType      string `json:"peerType"`
+	StatusCode    int32  `json:"statusCode"`
+	ContentLength int64  `json:"contentLength"`
+	ApplicationID string `json:"applicationId,omitempty"`
+}
+
+type jsonHttpStartStop struct {
+	StartTimestamp int64    `json:"startTimestamp"`
+	StopTimestamp  int64    `json:"stopTimestamp"`
+	RequestID      string   `json:"requestId,omitempty"`
+	PeerType       string   `json:"peerType"`
+	Method         string   `json:"method"`
+	URI            string   `json:"uri"`
+	RemoteAddress  string   `json:"remoteAddress,omitempty"`
+	UserAgent      string   `json:"userAgent,omitempty"`
+	StatusCode     int32    `json:"statusCode"`
+	ContentLength  int64    `json:"contentLength"`
+	ApplicationID  string   `json:"applicationId,omitempty"`
+	InstanceIndex  int32    `json:"instanceIndex,omitempty"`
+	InstanceID     string   `json:"instanceId,omitempty"`
+	Forwarded      []string `json:"forwarded,omitempty"`
+}
+
+// jsonUUID leaves out the UUIDs an event does not carry.
+func jsonUUID(id *events.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return uuidString(id)
+}
+
+func envelopeJSON(envelope *events.Envelope) ([]byte, error) {
+	out := jsonEnvelope{
+		Origin:          envelope.GetOrigin(),
+		EventType:       envelope.GetEventType().String(),
+		Timestamp:       envelope.GetTimestamp(),
+		Deployment:      envelope.GetDeployment(),
+		Job:             envelope.GetJob(),
+		Index:           envelope.GetIndex(),
+		IP:              envelope.GetIp(),
+		Tags:            envelope.GetTags(),
+		ValueMetric:     envelope.GetValueMetric(),
+		CounterEvent:    envelope.GetCounterEvent(),
+		Error:           envelope.GetError(),
+		ContainerMetric: envelope.GetContainerMetric(),
+	}
+	if logMessage := envelope.GetLogMessage(); logMessage != nil {
+		out.LogMessage = &jsonLogMessage{
+			Message:        string(logMessage.GetMessage()),
+			MessageType:    logMessage.GetMessageType().String(),
+			Timestamp:      logMessage.GetTimestamp(),
+			AppID:          logMessage.GetAppId(),
+			SourceType:     logMessage.GetSourceType(),
+			SourceInstance: logMessage.GetSourceInstance(),
+		}
+	}
+	if start := envelope.GetHttpStart(); start != nil {
+		out.HttpStart = &jsonHttpStart{
+			Timestamp:       start.GetTimestamp(),
+			RequestID:       jsonUUID(start.GetRequestId()),
+			PeerType:        start.GetPeerType().String(),
+			Method:          start.GetMethod().String(),
+			URI:             start.GetUri(),
+			RemoteAddress:   start.GetRemoteAddress(),
+			UserAgent:       start.GetUserAgent(),
+			ParentRequestID: jsonUUID(start.GetParentRequestId()),
+			ApplicationID:   jsonUUID(start.GetApplicationId()),
+			InstanceIndex:   start.GetInstanceIndex(),
+			InstanceID:      start.GetInstanceId(),
+		}
+	}
+	if stop := envelope.GetHttpStop(); stop != nil {
+		out.HttpStop = &jsonHttpStop{
+			Timestamp:     stop.GetTimestamp(),
+			URI:           stop.GetUri(),
+			RequestID:     jsonUUID(stop.GetRequestId()),
+			PeerType:      stop.GetPeerType().String(),
+			StatusCode:    stop.GetStatusCode(),
+			ContentLength: stop.GetContentLength(),
+			ApplicationID: jsonUUID(stop.GetApplicationId()),
+		}
+	}
+	if startStop := envelope.GetHttpStartStop(); startStop != nil {
+		out.HttpStartStop = &jsonHttpStartStop{
+			StartTimestamp: startStop.GetStartTimestamp(),
+			StopTimestamp:  startStop.GetStopTimestamp(),
+			RequestID:      jsonUUID(startStop.GetRequestId()),
+			PeerType:       startStop.GetPeerType().String(),
+			Method:         startStop.GetMethod().String(),
+			URI:            startStop.GetUri(),
+			RemoteAddress:  startStop.GetRemoteAddress(),
+			UserAgent:      startStop.GetUserAgent(),
+			StatusCode:     startStop.GetStatusCode(),
+			ContentLength:  startStop.GetContentLength(),
+			ApplicationID:  jsonUUID(startStop.GetApplicationId()),
+			InstanceIndex:  startStop.GetInstanceIndex(),
+			InstanceID:     startStop.GetInstanceId(),
+			Forwarded:      startStop.GetForwarded(),
+		}
+	}
+	return json.Marshal(out)
+}
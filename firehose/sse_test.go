@@ -0,0 +1,162 @@
+package firehose
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("sseServer", func() {
+	var s *sseServer
+
+	logMessage := func(origin, appID, message string) *events.Envelope {
+		return &events.Envelope{
+			Origin:    proto.String(origin),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(42),
+			LogMessage: &events.LogMessage{
+				Message:     []byte(message),
+				MessageType: events.LogMessage_ERR.Enum(),
+				Timestamp:   proto.Int64(41),
+				AppId:       proto.String(appID),
+			},
+		}
+	}
+
+	valueMetric := func(origin string) *events.Envelope {
+		return &events.Envelope{
+			Origin:      proto.String(origin),
+			EventType:   events.Envelope_ValueMetric.Enum(),
+			ValueMetric: &events.ValueMetric{Name: proto.String("latency"), Value: proto.Float64(1.5), Unit: proto.String("ms")},
+		}
+	}
+
+	subscribe := func(query string) (*http.Response, *bufio.Reader) {
+		response, err := http.Get("http://" + s.listener.Addr().String() + "/events" + query)
+		Expect(err).NotTo(HaveOccurred())
+		return response, bufio.NewReader(response.Body)
+	}
+
+	BeforeEach(func() {
+		var err error
+		s, err = newSSEServer("127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+	})
+
+	It("encodes envelopes as JSON", func() {
+		data, err := envelopeJSON(logMessage("rep", "app-guid", "hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"origin":"rep","eventType":"LogMessage","timestamp":42,"logMessage":{"message":"hello","messageType":"ERR","timestamp":41,"appId":"app-guid"}}`))
+
+		data, err = envelopeJSON(valueMetric("gorouter"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"valueMetric":{"name":"latency","value":1.5,"unit":"ms"}`))
+	})
+
+	It("spells out request IDs and HTTP enums", func() {
+		data, err := envelopeJSON(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1),
+				StopTimestamp:  proto.Int64(2),
+				RequestId:      &events.UUID{Low: proto.Uint64(0x0706050403020100), High: proto.Uint64(0x0f0e0d0c0b0a0908)},
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				Uri:            proto.String("/v2/info"),
+				StatusCode:     proto.Int32(200),
+				ContentLength:  proto.Int64(512),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"httpStartStop":{"startTimestamp":1,"stopTimestamp":2,"requestId":"00010203-0405-0607-0809-0a0b0c0d0e0f","peerType":"Client","method":"GET","uri":"/v2/info","statusCode":200,"contentLength":512}`))
+
+		data, err = envelopeJSON(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			EventType: events.Envelope_HttpStop.Enum(),
+			HttpStop: &events.HttpStop{
+				Timestamp: proto.Int64(3),
+				Uri:       proto.String("/v2/info"),
+				PeerType:  events.PeerType_Server.Enum(),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"httpStop":{"timestamp":3,"uri":"/v2/info","peerType":"Server","statusCode":0,"contentLength":0}`))
+	})
+
+	It("streams the envelopes as server-sent events", func() {
+		response, reader := subscribe("")
+		defer response.Body.Close()
+		Expect(response.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+		Eventually(s.clientCount).Should(Equal(1))
+
+		Expect(s.Write(valueMetric("gorouter"))).To(Succeed())
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(HavePrefix(`data: {"origin":"gorouter","eventType":"ValueMetric"`))
+		Expect(reader.ReadString('\n')).To(Equal("\n"))
+	})
+
+	It("applies the filters of each connection", func() {
+		response, reader := subscribe("?type=LogMessage,Error&origin=rep&app=app-guid")
+		defer response.Body.Close()
+		Eventually(s.clientCount).Should(Equal(1))
+
+		s.Write(valueMetric("rep"))
+		s.Write(logMessage("gorouter", "app-guid", "wrong origin"))
+		s.Write(logMessage("rep", "other-app", "wrong app"))
+		s.Write(logMessage("rep", "app-guid", "wanted"))
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(ContainSubstring(`"message":"wanted"`))
+	})
+
+	It("rejects unknown event types", func() {
+		response, _ := subscribe("?type=Bogus")
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+		body, _ := ioutil.ReadAll(response.Body)
+		Expect(string(body)).To(ContainSubstring("Unable to recognize event type Bogus"))
+	})
+
+	It("ends the streams when closed", func() {
+		response, _ := subscribe("")
+		defer response.Body.Close()
+		Eventually(s.clientCount).Should(Equal(1))
+
+		s.Close()
+		_, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("counts the events dropped for clients that fall behind", func() {
+		client := &sseClient{messages: make(chan []byte, sseClientBuffer)}
+		Expect(s.add(client)).To(BeTrue())
+		for i := 0; i < sseClientBuffer+3; i++ {
+			Expect(s.Write(valueMetric("gorouter"))).To(Succeed())
+		}
+		Expect(s.droppedCount()).To(Equal(3))
+	})
+
+	It("does not let other sites read the stream", func() {
+		response, _ := subscribe("")
+		defer response.Body.Close()
+		Expect(response.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("forgets clients that disconnect", func() {
+		response, _ := subscribe("")
+		Eventually(s.clientCount).Should(Equal(1))
+		response.Body.Close()
+		Eventually(s.clientCount).Should(Equal(0))
+	})
+})
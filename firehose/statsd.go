@@ -0,0 +1,109 @@
+package firehose
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	defaultStatsdTemplate = "{origin}.{name}"
+	defaultStatsdSanitize = `[^a-zA-Z0-9_.\-]`
+	statsdHTTPName        = "http_request"
+)
+
+var (
+	statsdTemplateField = regexp.MustCompile(`\{([^}]*)\}`)
+	repeatedDots        = regexp.MustCompile(`\.{2,}`)
+)
+
+var statsdFields = map[string]func(*events.Envelope, string) string{
+	"origin":     func(e *events.Envelope, _ string) string { return e.GetOrigin() },
+	"deployment": func(e *events.Envelope, _ string) string { return e.GetDeployment() },
+	"job":        func(e *events.Envelope, _ string) string { return e.GetJob() },
+	"index":      func(e *events.Envelope, _ string) string { return e.GetIndex() },
+	"name":       func(_ *events.Envelope, name string) string { return name },
+}
+
+// statsdSink forwards CounterEvent deltas as counters, ValueMetrics as
+// gauges and HttpStartStop durations as timers over UDP.
+type statsdSink struct {
+	conn     io.WriteCloser
+	template string
+	sanitize *regexp.Regexp
+}
+
+func newStatsdSink(address, template, sanitize string) (*statsdSink, error) {
+	if template == "" {
+		template = defaultStatsdTemplate
+	}
+	for _, match := range statsdTemplateField.FindAllStringSubmatch(template, -1) {
+		if _, ok := statsdFields[match[1]]; !ok {
+			return nil, fmt.Errorf("Unable to recognize statsd template field %s. Use origin, deployment, job, index or name", match[0])
+		}
+	}
+
+	if sanitize == "" {
+		sanitize = defaultStatsdSanitize
+	}
+	sanitizer, err := regexp.Compile(sanitize)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse statsd sanitize pattern %s: %s", sanitize, err)
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to statsd at %s: %s", address, err)
+	}
+
+	return &statsdSink{conn: conn, template: template, sanitize: sanitizer}, nil
+}
+
+func (s *statsdSink) Write(envelope *events.Envelope) error {
+	for _, line := range s.lines(envelope) {
+		if _, err := io.WriteString(s.conn, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// lines returns the statsd messages for the envelope, one per datagram.
+func (s *statsdSink) lines(envelope *events.Envelope) []string {
+	switch envelope.GetEventType() {
+	case events.Envelope_CounterEvent:
+		counter := envelope.GetCounterEvent()
+		return []string{fmt.Sprintf("%s:%d|c", s.name(envelope, counter.GetName()), counter.GetDelta())}
+	case events.Envelope_ValueMetric:
+		metric := envelope.GetValueMetric()
+		name := s.name(envelope, metric.GetName())
+		gauge := fmt.Sprintf("%s:%s|g", name, formatFloat(metric.GetValue()))
+		if metric.GetValue() < 0 {
+			// A signed gauge value is a relative change, so reset it first.
+			return []string{name + ":0|g", gauge}
+		}
+		return []string{gauge}
+	case events.Envelope_HttpStartStop:
+		request := envelope.GetHttpStartStop()
+		duration := float64(request.GetStopTimestamp()-request.GetStartTimestamp()) / 1e6
+		return []string{fmt.Sprintf("%s:%s|ms", s.name(envelope, statsdHTTPName), strconv.FormatFloat(duration, 'f', -1, 64))}
+	}
+	return nil
+}
+
+func (s *statsdSink) name(envelope *events.Envelope, name string) string {
+	result := statsdTemplateField.ReplaceAllStringFunc(s.template, func(field string) string {
+		value := statsdFields[strings.Trim(field, "{}")](envelope, name)
+		return s.sanitize.ReplaceAllString(value, "_")
+	})
+	return strings.Trim(repeatedDots.ReplaceAllString(result, "."), ".")
+}
@@ -0,0 +1,100 @@
+package firehose
+
+import (
+	"net"
+	"regexp"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("statsdSink", func() {
+	var (
+		conn net.PacketConn
+		s    *statsdSink
+	)
+
+	envelope := func(eventType events.Envelope_EventType) *events.Envelope {
+		return &events.Envelope{
+			Origin:     proto.String("gorouter"),
+			EventType:  eventType.Enum(),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("router"),
+			Index:      proto.String("0"),
+		}
+	}
+
+	receive := func() string {
+		buffer := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		return string(buffer[:n])
+	}
+
+	BeforeEach(func() {
+		var err error
+		conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = newStatsdSink(conn.LocalAddr().String(), "", "")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		conn.Close()
+	})
+
+	It("forwards counter deltas as counters", func() {
+		e := envelope(events.Envelope_CounterEvent)
+		e.CounterEvent = &events.CounterEvent{Name: proto.String("requests"), Delta: proto.Uint64(3), Total: proto.Uint64(40)}
+		Expect(s.Write(e)).To(Succeed())
+		Expect(receive()).To(Equal("gorouter.requests:3|c"))
+	})
+
+	It("forwards value metrics as gauges", func() {
+		e := envelope(events.Envelope_ValueMetric)
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("latency"), Value: proto.Float64(12.5)}
+		Expect(s.Write(e)).To(Succeed())
+		Expect(receive()).To(Equal("gorouter.latency:12.5|g"))
+	})
+
+	It("resets a gauge before setting it to a negative value", func() {
+		e := envelope(events.Envelope_ValueMetric)
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("skew"), Value: proto.Float64(-2)}
+		Expect(s.Write(e)).To(Succeed())
+		Expect(receive()).To(Equal("gorouter.skew:0|g"))
+		Expect(receive()).To(Equal("gorouter.skew:-2|g"))
+	})
+
+	It("forwards HTTP request durations as timers", func() {
+		e := envelope(events.Envelope_HttpStartStop)
+		e.HttpStartStop = &events.HttpStartStop{StartTimestamp: proto.Int64(1000000), StopTimestamp: proto.Int64(13500000)}
+		Expect(s.Write(e)).To(Succeed())
+		Expect(receive()).To(Equal("gorouter.http_request:12.5|ms"))
+	})
+
+	It("ignores other event types", func() {
+		Expect(s.lines(envelope(events.Envelope_LogMessage))).To(BeEmpty())
+	})
+
+	It("builds names from the template and sanitizes the fields", func() {
+		s.template = "{deployment}.{job}.{index}.{name}"
+		e := envelope(events.Envelope_ValueMetric)
+		e.Index = nil
+		e.ValueMetric = &events.ValueMetric{Name: proto.String("cpu usage/total")}
+		Expect(s.lines(e)).To(Equal([]string{"cf.router.cpu_usage_total:0|g"}))
+
+		s.sanitize = regexp.MustCompile(`[^a-z.]`)
+		e.ValueMetric.Name = proto.String("CPU.total")
+		Expect(s.lines(e)).To(Equal([]string{"cf.router.___.total:0|g"}))
+	})
+
+	It("rejects unknown template fields and invalid patterns", func() {
+		_, err := newStatsdSink(conn.LocalAddr().String(), "{origin}.{app}", "")
+		Expect(err).To(MatchError(ContainSubstring("Unable to recognize statsd template field {app}")))
+		_, err = newStatsdSink(conn.LocalAddr().String(), "", "[")
+		Expect(err).To(MatchError(ContainSubstring("Unable to parse statsd sanitize pattern [")))
+	})
+})
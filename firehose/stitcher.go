@@ -0,0 +1,163 @@
+package firehose
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// stitcher joins the HttpStart and HttpStop events of older components
+// into a single HttpStartStop event per request. Events whose counterpart
+// does not arrive within the timeout are reported as orphans.
+type stitcher struct {
+	timeout time.Duration
+	now     func() time.Time
+
+	starts map[string]*pendingStart
+	stops  map[string]*pendingStop
+
+	stitched int
+	orphans  int
+}
+
+type pendingStart struct {
+	envelope *events.Envelope
+	received time.Time
+}
+
+type pendingStop struct {
+	envelope *events.Envelope
+	received time.Time
+}
+
+func newStitcher(timeout time.Duration) *stitcher {
+	return &stitcher{
+		timeout: timeout,
+		now:     time.Now,
+		starts:  make(map[string]*pendingStart),
+		stops:   make(map[string]*pendingStop),
+	}
+}
+
+func (s *stitcher) enabled() bool {
+	return s.timeout > 0
+}
+
+// stitch consumes HttpStart and HttpStop envelopes, returning the combined
+// HttpStartStop envelope once both halves of a request have been seen, and
+// nil until then. It reports false for any other envelope, which passes
+// through untouched.
+func (s *stitcher) stitch(envelope *events.Envelope) (*events.Envelope, bool) {
+	if !s.enabled() {
+		return nil, false
+	}
+
+	switch envelope.GetEventType() {
+	case events.Envelope_HttpStart:
+		start := envelope.GetHttpStart()
+		key := stitchKey(start.GetRequestId(), start.GetPeerType())
+		if pending, ok := s.stops[key]; ok {
+			delete(s.stops, key)
+			return s.join(envelope, pending.envelope), true
+		}
+		s.starts[key] = &pendingStart{envelope: envelope, received: s.now()}
+		return nil, true
+	case events.Envelope_HttpStop:
+		stop := envelope.GetHttpStop()
+		key := stitchKey(stop.GetRequestId(), stop.GetPeerType())
+		if pending, ok := s.starts[key]; ok {
+			delete(s.starts, key)
+			return s.join(pending.envelope, envelope), true
+		}
+		s.stops[key] = &pendingStop{envelope: envelope, received: s.now()}
+		return nil, true
+	}
+	return nil, false
+}
+
+// expire reports the events that waited longer than the timeout for their
+// counterpart.
+func (s *stitcher) expire() []string {
+	return s.orphaned(s.now().Add(-s.timeout))
+}
+
+// flush reports every event still waiting for its counterpart.
+func (s *stitcher) flush() []string {
+	return s.orphaned(s.now())
+}
+
+func (s *stitcher) orphaned(cutoff time.Time) []string {
+	var lines []string
+	for key, pending := range s.starts {
+		if pending.received.After(cutoff) {
+			continue
+		}
+		start := pending.envelope.GetHttpStart()
+		lines = append(lines, fmt.Sprintf("Orphaned HttpStart for request %s: %s %s, no HttpStop within %s",
+			uuidString(start.GetRequestId()), start.GetMethod(), start.GetUri(), s.timeout))
+		delete(s.starts, key)
+	}
+	for key, pending := range s.stops {
+		if pending.received.After(cutoff) {
+			continue
+		}
+		stop := pending.envelope.GetHttpStop()
+		lines = append(lines, fmt.Sprintf("Orphaned HttpStop for request %s: %s returned %d, no HttpStart within %s",
+			uuidString(stop.GetRequestId()), stop.GetUri(), stop.GetStatusCode(), s.timeout))
+		delete(s.stops, key)
+	}
+	s.orphans += len(lines)
+	sort.Strings(lines)
+	return lines
+}
+
+// join builds the HttpStartStop envelope of a request from the envelopes
+// of its two halves.
+func (s *stitcher) join(startEnvelope, stopEnvelope *events.Envelope) *events.Envelope {
+	s.stitched++
+	start := startEnvelope.GetHttpStart()
+	stop := stopEnvelope.GetHttpStop()
+	return &events.Envelope{
+		Origin:     startEnvelope.Origin,
+		EventType:  events.Envelope_HttpStartStop.Enum(),
+		Timestamp:  stopEnvelope.Timestamp,
+		Deployment: startEnvelope.Deployment,
+		Job:        startEnvelope.Job,
+		Index:      startEnvelope.Index,
+		Ip:         startEnvelope.Ip,
+		HttpStartStop: &events.HttpStartStop{
+			StartTimestamp: start.Timestamp,
+			StopTimestamp:  stop.Timestamp,
+			RequestId:      start.RequestId,
+			PeerType:       start.PeerType,
+			Method:         start.Method,
+			Uri:            start.Uri,
+			RemoteAddress:  start.RemoteAddress,
+			UserAgent:      start.UserAgent,
+			StatusCode:     stop.StatusCode,
+			ContentLength:  stop.ContentLength,
+			ApplicationId:  start.ApplicationId,
+			InstanceIndex:  start.InstanceIndex,
+			InstanceId:     start.InstanceId,
+		},
+	}
+}
+
+// describe renders an HttpStartStop envelope as a one-line record. It
+// reports false for other envelopes, which are displayed as they are.
+func (s *stitcher) describe(envelope *events.Envelope) (string, bool) {
+	if !s.enabled() || envelope.GetEventType() != events.Envelope_HttpStartStop {
+		return "", false
+	}
+	request := envelope.GetHttpStartStop()
+	duration := time.Duration(request.GetStopTimestamp() - request.GetStartTimestamp())
+	return fmt.Sprintf("Request %s (%s): %s %s returned %d with %s bytes in %s",
+		uuidString(request.GetRequestId()), request.GetPeerType(), request.GetMethod(), request.GetUri(),
+		request.GetStatusCode(), formatCount(int(request.GetContentLength())), duration), true
+}
+
+func stitchKey(requestID *events.UUID, peerType events.PeerType) string {
+	return fmt.Sprintf("%s/%s", uuidString(requestID), peerType)
+}
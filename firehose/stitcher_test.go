@@ -0,0 +1,116 @@
+package firehose
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stitcher", func() {
+	var (
+		s   *stitcher
+		now time.Time
+	)
+
+	requestID := func(low uint64) *events.UUID {
+		return &events.UUID{Low: proto.Uint64(low), High: proto.Uint64(0)}
+	}
+
+	start := func(id *events.UUID, peerType events.PeerType, timestamp int64) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_HttpStart.Enum(),
+			HttpStart: &events.HttpStart{
+				Timestamp: proto.Int64(timestamp),
+				RequestId: id,
+				PeerType:  peerType.Enum(),
+				Method:    events.Method_POST.Enum(),
+				Uri:       proto.String("http://example.com/orders"),
+			},
+		}
+	}
+
+	stop := func(id *events.UUID, peerType events.PeerType, timestamp int64) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_HttpStop.Enum(),
+			HttpStop: &events.HttpStop{
+				Timestamp:     proto.Int64(timestamp),
+				RequestId:     id,
+				PeerType:      peerType.Enum(),
+				Uri:           proto.String("http://example.com/orders"),
+				StatusCode:    proto.Int32(201),
+				ContentLength: proto.Int64(1536),
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Unix(1000, 0)
+		s = newStitcher(30 * time.Second)
+		s.now = func() time.Time { return now }
+	})
+
+	It("passes everything through when disabled", func() {
+		s = newStitcher(0)
+		_, ok := s.stitch(start(requestID(1), events.PeerType_Client, 0))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("passes other event types through", func() {
+		_, ok := s.stitch(&events.Envelope{EventType: events.Envelope_HttpStartStop.Enum()})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("combines a start and a stop into one HttpStartStop event", func() {
+		joined, ok := s.stitch(start(requestID(1), events.PeerType_Client, 1000000))
+		Expect(ok).To(BeTrue())
+		Expect(joined).To(BeNil())
+
+		joined, ok = s.stitch(stop(requestID(1), events.PeerType_Client, 13000000))
+		Expect(ok).To(BeTrue())
+		Expect(joined.GetEventType()).To(Equal(events.Envelope_HttpStartStop))
+		Expect(joined.GetHttpStartStop().GetMethod()).To(Equal(events.Method_POST))
+		Expect(joined.GetHttpStartStop().GetStatusCode()).To(Equal(int32(201)))
+		Expect(s.stitched).To(Equal(1))
+		Expect(s.flush()).To(BeEmpty())
+
+		record, ok := s.describe(joined)
+		Expect(ok).To(BeTrue())
+		Expect(record).To(Equal("Request 01000000-0000-0000-0000-000000000000 (Client): POST http://example.com/orders returned 201 with 1,536 bytes in 12ms"))
+	})
+
+	It("combines a stop arriving before its start", func() {
+		s.stitch(stop(requestID(1), events.PeerType_Server, 3000000))
+		joined, _ := s.stitch(start(requestID(1), events.PeerType_Server, 1000000))
+		record, _ := s.describe(joined)
+		Expect(record).To(ContainSubstring("returned 201 with 1,536 bytes in 2ms"))
+	})
+
+	It("keeps the client and server sides of a request apart", func() {
+		s.stitch(start(requestID(1), events.PeerType_Client, 0))
+		joined, _ := s.stitch(stop(requestID(1), events.PeerType_Server, 0))
+		Expect(joined).To(BeNil())
+	})
+
+	It("describes only HttpStartStop events", func() {
+		_, ok := s.describe(start(requestID(1), events.PeerType_Client, 0))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("reports events whose counterpart did not arrive in time", func() {
+		s.stitch(start(requestID(1), events.PeerType_Client, 0))
+		now = now.Add(20 * time.Second)
+		s.stitch(stop(requestID(2), events.PeerType_Client, 0))
+		now = now.Add(15 * time.Second)
+
+		Expect(s.expire()).To(Equal([]string{
+			"Orphaned HttpStart for request 01000000-0000-0000-0000-000000000000: POST http://example.com/orders, no HttpStop within 30s",
+		}))
+		Expect(s.flush()).To(Equal([]string{
+			"Orphaned HttpStop for request 02000000-0000-0000-0000-000000000000: http://example.com/orders returned 201, no HttpStart within 30s",
+		}))
+		Expect(s.orphans).To(Equal(2))
+	})
+})
@@ -0,0 +1,39 @@
+package firehose
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type stopConditions struct {
+	count     int
+	until     *regexp.Regexp
+	displayed int
+}
+
+func newStopConditions(options *ClientOptions) (*stopConditions, error) {
+	conditions := &stopConditions{count: options.Count}
+	if options.Until != "" {
+		until, err := regexp.Compile(options.Until)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse pattern %s: %s", options.Until, err.Error())
+		}
+		conditions.until = until
+	}
+	return conditions, nil
+}
+
+// reached records a displayed envelope and returns a description of the
+// stop condition it satisfied, if any.
+func (s *stopConditions) reached(envelope *events.Envelope) (string, bool) {
+	s.displayed++
+	if s.until != nil && s.until.MatchString(envelope.String()) {
+		return fmt.Sprintf("found a message matching %s", s.until.String()), true
+	}
+	if s.count > 0 && s.displayed >= s.count {
+		return fmt.Sprintf("reached count of %d", s.count), true
+	}
+	return "", false
+}
@@ -0,0 +1,376 @@
+//go:build cgo
+// +build cgo
+
+package firehose
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	storeBatchSize     = 1000
+	storeBatchInterval = time.Second
+	storeTimeFormat    = "2006-01-02 15:04:05.000000"
+)
+
+// StoreSupported reports whether this build can write stores with --store
+// and query them. The SQLite driver needs cgo.
+const StoreSupported = true
+
+// storeSchema keeps the fields common to all envelopes in one table and
+// the event specific ones in a table per event type, sharing the envelope
+// id. Times are stored in UTC in the format SQLite's date functions use.
+var storeSchema = []string{
+	`CREATE TABLE IF NOT EXISTS envelopes (
+		id INTEGER PRIMARY KEY,
+		time TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		origin TEXT,
+		deployment TEXT,
+		job TEXT,
+		"index" TEXT,
+		ip TEXT,
+		tags TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS envelopes_time ON envelopes (time)`,
+	`CREATE INDEX IF NOT EXISTS envelopes_event_type ON envelopes (event_type, time)`,
+	`CREATE INDEX IF NOT EXISTS envelopes_origin ON envelopes (origin, time)`,
+
+	`CREATE TABLE IF NOT EXISTS log_messages (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		time TEXT NOT NULL,
+		app_id TEXT,
+		source_type TEXT,
+		source_instance TEXT,
+		message_type TEXT,
+		message TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_messages_app_id ON log_messages (app_id, time)`,
+
+	`CREATE TABLE IF NOT EXISTS value_metrics (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		name TEXT,
+		value REAL,
+		unit TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS value_metrics_name ON value_metrics (name)`,
+
+	`CREATE TABLE IF NOT EXISTS counter_events (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		name TEXT,
+		delta INTEGER,
+		total INTEGER
+	)`,
+	`CREATE INDEX IF NOT EXISTS counter_events_name ON counter_events (name)`,
+
+	`CREATE TABLE IF NOT EXISTS container_metrics (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		application_id TEXT,
+		instance_index INTEGER,
+		cpu_percentage REAL,
+		memory_bytes INTEGER,
+		disk_bytes INTEGER,
+		memory_bytes_quota INTEGER,
+		disk_bytes_quota INTEGER
+	)`,
+	`CREATE INDEX IF NOT EXISTS container_metrics_application_id ON container_metrics (application_id, instance_index)`,
+
+	`CREATE TABLE IF NOT EXISTS errors (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		source TEXT,
+		code INTEGER,
+		message TEXT
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS http_start_stops (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		start_time TEXT,
+		stop_time TEXT,
+		duration_ms REAL,
+		request_id TEXT,
+		peer_type TEXT,
+		method TEXT,
+		uri TEXT,
+		remote_address TEXT,
+		user_agent TEXT,
+		status_code INTEGER,
+		content_length INTEGER,
+		application_id TEXT,
+		instance_index INTEGER,
+		instance_id TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS http_start_stops_application_id ON http_start_stops (application_id, start_time)`,
+	`CREATE INDEX IF NOT EXISTS http_start_stops_status_code ON http_start_stops (status_code, start_time)`,
+	`CREATE INDEX IF NOT EXISTS http_start_stops_request_id ON http_start_stops (request_id)`,
+
+	`CREATE TABLE IF NOT EXISTS http_starts (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		time TEXT,
+		request_id TEXT,
+		parent_request_id TEXT,
+		peer_type TEXT,
+		method TEXT,
+		uri TEXT,
+		remote_address TEXT,
+		user_agent TEXT,
+		application_id TEXT,
+		instance_index INTEGER,
+		instance_id TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS http_starts_request_id ON http_starts (request_id)`,
+
+	`CREATE TABLE IF NOT EXISTS http_stops (
+		envelope_id INTEGER PRIMARY KEY REFERENCES envelopes (id),
+		time TEXT,
+		request_id TEXT,
+		peer_type TEXT,
+		uri TEXT,
+		status_code INTEGER,
+		content_length INTEGER,
+		application_id TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS http_stops_request_id ON http_stops (request_id)`,
+}
+
+// captureStore is a Sink that writes the envelopes into a SQLite database,
+// committing them in batches of storeBatchSize and at least every
+// storeBatchInterval, so a quiet stream does not keep rows uncommitted.
+type captureStore struct {
+	db *sql.DB
+
+	lock    sync.Mutex
+	tx      *sql.Tx
+	pending int
+	err     error
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newCaptureStore(path string) (*captureStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open store %s: %s", path, err)
+	}
+	for _, statement := range storeSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Unable to create the schema of store %s: %s", path, err)
+		}
+	}
+	s := &captureStore{
+		db:      db,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.commitEvery(storeBatchInterval)
+	return s, nil
+}
+
+// commitEvery commits the pending envelopes at the given interval until
+// the store is closed. A failed commit is returned by the next Write.
+func (s *captureStore) commitEvery(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.lock.Lock()
+			if err := s.commit(); err != nil && s.err == nil {
+				s.err = err
+			}
+			s.lock.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *captureStore) Write(envelope *events.Envelope) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.err; err != nil {
+		s.err = nil
+		return err
+	}
+
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("Unable to write to store: %s", err)
+		}
+		s.tx = tx
+	}
+
+	if err := s.insert(envelope); err != nil {
+		return fmt.Errorf("Unable to write to store: %s", err)
+	}
+
+	s.pending++
+	if s.pending >= storeBatchSize {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *captureStore) Close() error {
+	close(s.done)
+	<-s.stopped
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.err
+	if commitErr := s.commit(); err == nil {
+		err = commitErr
+	}
+	if closeErr := s.db.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("Unable to close store: %s", closeErr)
+	}
+	return err
+}
+
+func (s *captureStore) commit() error {
+	s.pending = 0
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Unable to write to store: %s", err)
+	}
+	return nil
+}
+
+func (s *captureStore) insert(envelope *events.Envelope) error {
+	var tags interface{}
+	if len(envelope.GetTags()) > 0 {
+		data, err := json.Marshal(envelope.GetTags())
+		if err != nil {
+			return err
+		}
+		tags = string(data)
+	}
+
+	result, err := s.tx.Exec(`INSERT INTO envelopes (time, timestamp, event_type, origin, deployment, job, "index", ip, tags) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		storeTime(envelope.GetTimestamp()), envelope.GetTimestamp(), envelope.GetEventType().String(),
+		envelope.GetOrigin(), envelope.GetDeployment(), envelope.GetJob(), envelope.GetIndex(), envelope.GetIp(), tags)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	switch envelope.GetEventType() {
+	case events.Envelope_LogMessage:
+		m := envelope.GetLogMessage()
+		_, err = s.tx.Exec(`INSERT INTO log_messages VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, storeTime(m.GetTimestamp()), m.GetAppId(), m.GetSourceType(), m.GetSourceInstance(), m.GetMessageType().String(), string(m.GetMessage()))
+	case events.Envelope_ValueMetric:
+		m := envelope.GetValueMetric()
+		_, err = s.tx.Exec(`INSERT INTO value_metrics VALUES (?, ?, ?, ?)`, id, m.GetName(), m.GetValue(), m.GetUnit())
+	case events.Envelope_CounterEvent:
+		m := envelope.GetCounterEvent()
+		_, err = s.tx.Exec(`INSERT INTO counter_events VALUES (?, ?, ?, ?)`, id, m.GetName(), int64(m.GetDelta()), int64(m.GetTotal()))
+	case events.Envelope_ContainerMetric:
+		m := envelope.GetContainerMetric()
+		_, err = s.tx.Exec(`INSERT INTO container_metrics VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, m.GetApplicationId(), m.GetInstanceIndex(), m.GetCpuPercentage(), int64(m.GetMemoryBytes()), int64(m.GetDiskBytes()),
+			optionalUint(m.MemoryBytesQuota), optionalUint(m.DiskBytesQuota))
+	case events.Envelope_Error:
+		m := envelope.GetError()
+		_, err = s.tx.Exec(`INSERT INTO errors VALUES (?, ?, ?, ?)`, id, m.GetSource(), m.GetCode(), m.GetMessage())
+	case events.Envelope_HttpStartStop:
+		m := envelope.GetHttpStartStop()
+		_, err = s.tx.Exec(`INSERT INTO http_start_stops VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, storeTime(m.GetStartTimestamp()), storeTime(m.GetStopTimestamp()), float64(m.GetStopTimestamp()-m.GetStartTimestamp())/1e6,
+			optionalUUID(m.GetRequestId()), m.GetPeerType().String(), m.GetMethod().String(), m.GetUri(), m.GetRemoteAddress(), m.GetUserAgent(),
+			m.GetStatusCode(), m.GetContentLength(), optionalUUID(m.GetApplicationId()), m.GetInstanceIndex(), m.GetInstanceId())
+	case events.Envelope_HttpStart:
+		m := envelope.GetHttpStart()
+		_, err = s.tx.Exec(`INSERT INTO http_starts VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, storeTime(m.GetTimestamp()), optionalUUID(m.GetRequestId()), optionalUUID(m.GetParentRequestId()), m.GetPeerType().String(),
+			m.GetMethod().String(), m.GetUri(), m.GetRemoteAddress(), m.GetUserAgent(), optionalUUID(m.GetApplicationId()), m.GetInstanceIndex(), m.GetInstanceId())
+	case events.Envelope_HttpStop:
+		m := envelope.GetHttpStop()
+		_, err = s.tx.Exec(`INSERT INTO http_stops VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, storeTime(m.GetTimestamp()), optionalUUID(m.GetRequestId()), m.GetPeerType().String(), m.GetUri(),
+			m.GetStatusCode(), m.GetContentLength(), optionalUUID(m.GetApplicationId()))
+	}
+	return err
+}
+
+func storeTime(timestamp int64) string {
+	return time.Unix(0, timestamp).UTC().Format(storeTimeFormat)
+}
+
+func optionalUUID(id *events.UUID) interface{} {
+	if id == nil {
+		return nil
+	}
+	return uuidString(id)
+}
+
+func optionalUint(value *uint64) interface{} {
+	if value == nil {
+		return nil
+	}
+	return int64(*value)
+}
+
+// QueryStore runs a query against a store written with --store and returns
+// the column names and the rows as strings, with NULL as an empty string.
+func QueryStore(path, query string) ([]string, [][]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("Unable to open store %s: %s", path, err)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to open store %s: %s", path, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to run query: %s", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to run query: %s", err)
+	}
+
+	var results [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, fmt.Errorf("Unable to run query: %s", err)
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			row[i] = value.String
+		}
+		results = append(results, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("Unable to run query: %s", err)
+	}
+	return columns, results, nil
+}
@@ -0,0 +1,24 @@
+//go:build !cgo
+// +build !cgo
+
+package firehose
+
+import (
+	"errors"
+)
+
+// StoreSupported reports whether this build can write stores with --store
+// and query them. The SQLite driver needs cgo.
+const StoreSupported = false
+
+var errStoreUnsupported = errors.New("This build of the plugin has no SQLite support, build it with cgo enabled to use --store and nozzle-query")
+
+func newCaptureStore(path string) (Sink, error) {
+	return nil, errStoreUnsupported
+}
+
+// QueryStore runs a query against a store written with --store, which this
+// build does not support.
+func QueryStore(path, query string) ([]string, [][]string, error) {
+	return nil, nil, errStoreUnsupported
+}
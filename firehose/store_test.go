@@ -0,0 +1,169 @@
+//go:build cgo
+// +build cgo
+
+package firehose
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("captureStore", func() {
+	var (
+		dir   string
+		path  string
+		store *captureStore
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "nozzle-store")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "capture.db")
+		store, err = newCaptureStore(path)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	query := func(sql string) [][]string {
+		_, rows, err := QueryStore(path, sql)
+		Expect(err).NotTo(HaveOccurred())
+		return rows
+	}
+
+	It("stores the common fields of every envelope", func() {
+		Expect(store.Write(&events.Envelope{
+			Origin:     proto.String("rep"),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Timestamp:  proto.Int64(1500000000123456789),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("diego_cell"),
+			Index:      proto.String("0"),
+			Tags:       map[string]string{"zone": "z1"},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("numCPUS"),
+				Value: proto.Float64(4),
+				Unit:  proto.String("count"),
+			},
+		})).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		Expect(query(`SELECT time, event_type, origin, deployment, job, "index", tags FROM envelopes`)).To(Equal([][]string{
+			{"2017-07-14 02:40:00.123456", "ValueMetric", "rep", "cf", "diego_cell", "0", `{"zone":"z1"}`},
+		}))
+		Expect(query(`SELECT name, value, unit FROM value_metrics JOIN envelopes ON envelopes.id = envelope_id`)).To(Equal([][]string{
+			{"numCPUS", "4", "count"},
+		}))
+	})
+
+	It("stores each event type in its own table", func() {
+		Expect(store.Write(&events.Envelope{
+			Origin:    proto.String("gorouter"),
+			EventType: events.Envelope_HttpStartStop.Enum(),
+			Timestamp: proto.Int64(1500000000000000000),
+			HttpStartStop: &events.HttpStartStop{
+				StartTimestamp: proto.Int64(1500000000000000000),
+				StopTimestamp:  proto.Int64(1500000000250000000),
+				RequestId:      &events.UUID{Low: proto.Uint64(0x0706050403020100), High: proto.Uint64(0x0f0e0d0c0b0a0908)},
+				PeerType:       events.PeerType_Client.Enum(),
+				Method:         events.Method_GET.Enum(),
+				Uri:            proto.String("http://app.example.com/"),
+				RemoteAddress:  proto.String("10.0.0.1:1234"),
+				UserAgent:      proto.String("curl"),
+				StatusCode:     proto.Int32(502),
+				ContentLength:  proto.Int64(42),
+			},
+		})).To(Succeed())
+		Expect(store.Write(&events.Envelope{
+			Origin:    proto.String("rep"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(1500000000000000000),
+			LogMessage: &events.LogMessage{
+				Message:     []byte("Exit status 1"),
+				MessageType: events.LogMessage_ERR.Enum(),
+				Timestamp:   proto.Int64(1500000000000000000),
+				AppId:       proto.String("app-guid"),
+				SourceType:  proto.String("CELL"),
+			},
+		})).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		Expect(query(`SELECT request_id, method, status_code, duration_ms, application_id IS NULL FROM http_start_stops`)).To(Equal([][]string{
+			{"00010203-0405-0607-0809-0a0b0c0d0e0f", "GET", "502", "250", "1"},
+		}))
+		Expect(query(`SELECT app_id, source_type, message_type, message FROM log_messages`)).To(Equal([][]string{
+			{"app-guid", "CELL", "ERR", "Exit status 1"},
+		}))
+		Expect(query(`SELECT event_type FROM envelopes ORDER BY id`)).To(Equal([][]string{
+			{"HttpStartStop"}, {"LogMessage"},
+		}))
+	})
+
+	It("appends to an existing store", func() {
+		envelope := &events.Envelope{
+			Origin:       proto.String("doppler"),
+			EventType:    events.Envelope_CounterEvent.Enum(),
+			Timestamp:    proto.Int64(1),
+			CounterEvent: &events.CounterEvent{Name: proto.String("dropped"), Delta: proto.Uint64(2), Total: proto.Uint64(5)},
+		}
+		Expect(store.Write(envelope)).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		var err error
+		store, err = newCaptureStore(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Write(envelope)).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		Expect(query(`SELECT count(*), sum(delta) FROM counter_events`)).To(Equal([][]string{{"2", "4"}}))
+	})
+
+	It("commits the pending envelopes while the stream is quiet", func() {
+		Expect(store.Write(&events.Envelope{
+			Origin:    proto.String("rep"),
+			EventType: events.Envelope_Error.Enum(),
+			Timestamp: proto.Int64(1),
+			Error:     &events.Error{Source: proto.String("rep"), Code: proto.Int32(1), Message: proto.String("quiet")},
+		})).To(Succeed())
+
+		Eventually(func() ([][]string, error) {
+			_, rows, err := QueryStore(path, `SELECT message FROM errors`)
+			return rows, err
+		}, 3*storeBatchInterval).Should(Equal([][]string{{"quiet"}}))
+		Expect(store.Close()).To(Succeed())
+	})
+
+	Describe("QueryStore", func() {
+		BeforeEach(func() {
+			Expect(store.Close()).To(Succeed())
+		})
+
+		It("returns the column names", func() {
+			columns, rows, err := QueryStore(path, `SELECT 1 AS one, NULL AS empty`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(columns).To(Equal([]string{"one", "empty"}))
+			Expect(rows).To(Equal([][]string{{"1", ""}}))
+		})
+
+		It("fails for a missing store instead of creating it", func() {
+			_, _, err := QueryStore(filepath.Join(dir, "missing.db"), `SELECT 1`)
+			Expect(err).To(MatchError(ContainSubstring("Unable to open store")))
+			_, statErr := os.Stat(filepath.Join(dir, "missing.db"))
+			Expect(os.IsNotExist(statErr)).To(BeTrue())
+		})
+
+		It("fails for an invalid query", func() {
+			_, _, err := QueryStore(path, `SELECT * FROM nothing`)
+			Expect(err).To(MatchError(ContainSubstring("Unable to run query")))
+		})
+	})
+})
@@ -0,0 +1,266 @@
+package firehose
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const defaultSubscriptionID = "FirehosePlugin"
+
+// ErrAppConnections is returned when several connections are asked for an
+// app stream, which doppler does not split between them.
+var ErrAppConnections = errors.New("Multiple connections are only supported for the firehose")
+
+// TokenError reports that no token could be obtained from the token
+// source. The stream does not connect.
+type TokenError struct {
+	Err error
+}
+
+func (e *TokenError) Error() string {
+	return "Unable to get a token: " + e.Err.Error()
+}
+
+// ConnectionError reports a connection to doppler that failed or ended
+// with an error.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+// SlowConsumerError reports that doppler closed a connection because the
+// stream was not consumed fast enough.
+type SlowConsumerError struct {
+	Alert string
+	Err   error
+}
+
+func (e *SlowConsumerError) Error() string {
+	return e.Err.Error()
+}
+
+// TokenSource provides the token to connect to doppler with. It is asked
+// again when doppler rejects a token.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same token.
+type StaticToken string
+
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// Nozzle streams envelopes from doppler. It is what Go programs can embed;
+// Client builds the nozzle commands on top of it.
+type Nozzle struct {
+	dopplerEndpoint string
+	appGUID         string
+	subscriptionID  string
+	connections     int
+	types           map[events.Envelope_EventType]bool
+	tlsConfig       *tls.Config
+	tokenSource     TokenSource
+	debugPrinter    consumer.DebugPrinter
+}
+
+// Option configures a Nozzle.
+type Option func(*Nozzle)
+
+// WithFilter only streams the envelopes of the given event types.
+func WithFilter(types ...events.Envelope_EventType) Option {
+	return func(n *Nozzle) {
+		n.types = make(map[events.Envelope_EventType]bool)
+		for _, envelopeType := range types {
+			n.types[envelopeType] = true
+		}
+	}
+}
+
+// WithSubscriptionID sets the subscription ID of the firehose connections.
+// Doppler splits the firehose between all the connections sharing one.
+func WithSubscriptionID(id string) Option {
+	return func(n *Nozzle) {
+		n.subscriptionID = id
+	}
+}
+
+// WithAppGUID streams the envelopes of an app rather than the firehose.
+func WithAppGUID(guid string) Option {
+	return func(n *Nozzle) {
+		n.appGUID = guid
+	}
+}
+
+// WithConnections opens the given number of firehose connections with the
+// same subscription ID and merges them into one stream.
+func WithConnections(connections int) Option {
+	return func(n *Nozzle) {
+		n.connections = connections
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connections.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(n *Nozzle) {
+		n.tlsConfig = config
+	}
+}
+
+// WithTokenSource sets where the token to connect with comes from.
+func WithTokenSource(source TokenSource) Option {
+	return func(n *Nozzle) {
+		n.tokenSource = source
+	}
+}
+
+// WithToken connects with the given token.
+func WithToken(token string) Option {
+	return WithTokenSource(StaticToken(token))
+}
+
+// WithDebugPrinter prints the websocket requests and responses.
+func WithDebugPrinter(printer consumer.DebugPrinter) Option {
+	return func(n *Nozzle) {
+		n.debugPrinter = printer
+	}
+}
+
+func NewNozzle(dopplerEndpoint string, options ...Option) *Nozzle {
+	n := &Nozzle{
+		dopplerEndpoint: dopplerEndpoint,
+		subscriptionID:  defaultSubscriptionID,
+		connections:     1,
+		tlsConfig:       &tls.Config{},
+	}
+	for _, option := range options {
+		option(n)
+	}
+	return n
+}
+
+// Stream connects to doppler and returns the envelopes received and the
+// errors of the connections. Errors are a *TokenError, *ConnectionError or
+// *SlowConsumerError, or ErrAppConnections. Both channels close once the
+// connections end, or once the context is done, which closes them; errors
+// caused by closing the connections are not reported. Read both channels
+// until they close.
+func (n *Nozzle) Stream(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	envelopes := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	fail := func(err error) (<-chan *events.Envelope, <-chan error) {
+		errs <- err
+		close(errs)
+		close(envelopes)
+		return envelopes, errs
+	}
+
+	if n.appGUID != "" && n.connections > 1 {
+		return fail(ErrAppConnections)
+	}
+	if n.tokenSource == nil {
+		return fail(&TokenError{Err: errors.New("no token source given")})
+	}
+	token, err := n.tokenSource.Token()
+	if err != nil {
+		return fail(&TokenError{Err: err})
+	}
+
+	connection := consumer.New(n.dopplerEndpoint, n.tlsConfig, nil)
+	connection.RefreshTokenFrom(tokenRefresher{n.tokenSource})
+	if n.debugPrinter != nil {
+		connection.SetDebugPrinter(n.debugPrinter)
+	}
+
+	var output <-chan *events.Envelope
+	var connectionErrors <-chan error
+	if n.appGUID != "" {
+		output, connectionErrors = connection.StreamWithoutReconnect(n.appGUID, token)
+	} else {
+		connections := n.connections
+		if connections < 1 {
+			connections = 1
+		}
+		outputs := make([]<-chan *events.Envelope, connections)
+		outputErrors := make([]<-chan error, connections)
+		for i := range outputs {
+			outputs[i], outputErrors[i] = connection.FirehoseWithoutReconnect(n.subscriptionID, token)
+		}
+		output, connectionErrors = mergeStreams(outputs, outputErrors)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Close()
+		case <-finished:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(envelopes)
+		for envelope := range output {
+			if ctx.Err() != nil || !n.matches(envelope) {
+				continue
+			}
+			select {
+			case envelopes <- envelope:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(errs)
+		for err := range connectionErrors {
+			if ctx.Err() != nil {
+				continue
+			}
+			select {
+			case errs <- streamError(err):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	return envelopes, errs
+}
+
+func (n *Nozzle) matches(envelope *events.Envelope) bool {
+	return len(n.types) == 0 || n.types[envelope.GetEventType()]
+}
+
+func streamError(err error) error {
+	if alert, ok := slowConsumerDisconnect(err); ok {
+		return &SlowConsumerError{Alert: alert, Err: err}
+	}
+	return &ConnectionError{Err: err}
+}
+
+// tokenRefresher lets noaa ask the token source for a new token when
+// doppler rejects one.
+type tokenRefresher struct {
+	source TokenSource
+}
+
+func (r tokenRefresher) RefreshAuthToken() (string, error) {
+	return r.source.Token()
+}
@@ -0,0 +1,113 @@
+package firehose_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cloudfoundry/firehose-plugin/firehose"
+	"github.com/cloudfoundry/firehose-plugin/testhelpers"
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (string, error) {
+	return "", errors.New("token expired")
+}
+
+var _ = Describe("Nozzle", func() {
+	var fakeFirehose *testhelpers.FakeFirehose
+
+	BeforeEach(func() {
+		fakeFirehose = testhelpers.NewFakeFirehose("ACCESS_TOKEN")
+		fakeFirehose.SendEvent(events.Envelope_LogMessage, "This is a very special test message")
+		fakeFirehose.SendEvent(events.Envelope_ValueMetric, "valuemetric")
+		fakeFirehose.Start()
+	})
+
+	AfterEach(func() {
+		fakeFirehose.Close()
+	})
+
+	receive := func(output <-chan *events.Envelope, errs <-chan error) ([]*events.Envelope, []error) {
+		var envelopes []*events.Envelope
+		var errors []error
+		for output != nil || errs != nil {
+			select {
+			case envelope, ok := <-output:
+				if !ok {
+					output = nil
+					continue
+				}
+				envelopes = append(envelopes, envelope)
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				errors = append(errors, err)
+			}
+		}
+		return envelopes, errors
+	}
+
+	It("streams the firehose until the connection closes", func() {
+		nozzle := firehose.NewNozzle(fakeFirehose.URL(), firehose.WithToken("ACCESS_TOKEN"), firehose.WithSubscriptionID("library"))
+		envelopes, _ := receive(nozzle.Stream(context.Background()))
+
+		Expect(envelopes).To(HaveLen(2))
+		Expect(fakeFirehose.LastAuthorization()).To(Equal("ACCESS_TOKEN"))
+		Expect(fakeFirehose.SubscriptionID()).To(Equal("library"))
+	})
+
+	It("only streams the event types of the filter", func() {
+		nozzle := firehose.NewNozzle(fakeFirehose.URL(), firehose.WithToken("ACCESS_TOKEN"), firehose.WithFilter(events.Envelope_ValueMetric))
+		envelopes, _ := receive(nozzle.Stream(context.Background()))
+
+		Expect(envelopes).To(HaveLen(1))
+		Expect(envelopes[0].GetValueMetric().GetName()).To(Equal("valuemetric"))
+	})
+
+	It("closes the connection once the context is done", func() {
+		fakeFirehose.KeepConnectionAlive()
+		defer fakeFirehose.CloseAliveConnection()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		nozzle := firehose.NewNozzle(fakeFirehose.URL(), firehose.WithToken("ACCESS_TOKEN"))
+		output, errs := nozzle.Stream(ctx)
+		Eventually(output).Should(Receive())
+		cancel()
+
+		_, errors := receive(output, errs)
+		Expect(errors).To(BeEmpty())
+	})
+
+	It("reports connection errors", func() {
+		nozzle := firehose.NewNozzle("badEndpoint", firehose.WithToken("ACCESS_TOKEN"))
+		_, errs := receive(nozzle.Stream(context.Background()))
+
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0]).To(BeAssignableToTypeOf(&firehose.ConnectionError{}))
+		Expect(errs[0].Error()).To(ContainSubstring("Error dialing trafficcontroller server"))
+	})
+
+	It("does not connect without a token", func() {
+		nozzle := firehose.NewNozzle(fakeFirehose.URL(), firehose.WithTokenSource(failingTokenSource{}))
+		_, errs := receive(nozzle.Stream(context.Background()))
+
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0]).To(BeAssignableToTypeOf(&firehose.TokenError{}))
+		Expect(errs[0]).To(MatchError("Unable to get a token: token expired"))
+		Expect(fakeFirehose.Requested()).To(BeFalse())
+	})
+
+	It("does not open several connections to an app stream", func() {
+		nozzle := firehose.NewNozzle(fakeFirehose.URL(), firehose.WithToken("ACCESS_TOKEN"), firehose.WithAppGUID("app-guid"), firehose.WithConnections(2))
+		_, errs := receive(nozzle.Stream(context.Background()))
+
+		Expect(errs).To(Equal([]error{firehose.ErrAppConnections}))
+		Expect(fakeFirehose.Requested()).To(BeFalse())
+	})
+})
@@ -0,0 +1,104 @@
+package firehose
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	syslogFacilityUser    = 1
+	syslogSeverityError   = 3
+	syslogSeverityInfo    = 6
+	syslogTimestampFormat = "2006-01-02T15:04:05.999999Z07:00"
+)
+
+// syslogSink forwards LogMessages as RFC 5424 messages over UDP, TCP or
+// TCP with TLS. Messages over TCP are framed by octet counting.
+type syslogSink struct {
+	conn          io.WriteCloser
+	octetCounting bool
+}
+
+func newSyslogSink(address string, tlsConfig *tls.Config) (*syslogSink, error) {
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Unable to parse syslog address %s. Use udp://, tcp:// or tcp+tls:// followed by HOST:PORT", address)
+	}
+
+	var conn net.Conn
+	var err error
+	switch parts[0] {
+	case "udp", "tcp":
+		conn, err = net.Dial(parts[0], parts[1])
+	case "tcp+tls":
+		conn, err = tls.Dial("tcp", parts[1], tlsConfig)
+	default:
+		return nil, fmt.Errorf("Unable to parse syslog address %s. Use udp://, tcp:// or tcp+tls:// followed by HOST:PORT", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to syslog at %s: %s", address, err)
+	}
+
+	return &syslogSink{conn: conn, octetCounting: parts[0] != "udp"}, nil
+}
+
+func (s *syslogSink) Write(envelope *events.Envelope) error {
+	if envelope.GetEventType() != events.Envelope_LogMessage {
+		return nil
+	}
+	message := syslogMessage(envelope.GetLogMessage())
+	if s.octetCounting {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+	_, err := io.WriteString(s.conn, message)
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// syslogMessage formats a log message the way syslog drains do: the app
+// GUID is the hostname, the source type the app name and the source
+// instance the process ID.
+func syslogMessage(logMessage *events.LogMessage) string {
+	severity := syslogSeverityInfo
+	if logMessage.GetMessageType() == events.LogMessage_ERR {
+		severity = syslogSeverityError
+	}
+	timestamp := time.Unix(0, logMessage.GetTimestamp()).UTC().Format(syslogTimestampFormat)
+	body := strings.TrimRight(string(logMessage.GetMessage()), "\r\n")
+
+	return fmt.Sprintf("<%d>1 %s %s %s %s - - %s",
+		syslogFacilityUser*8+severity,
+		timestamp,
+		syslogHeaderField(logMessage.GetAppId(), 255),
+		syslogHeaderField(logMessage.GetSourceType(), 48),
+		syslogHeaderField(logMessage.GetSourceInstance(), 128),
+		body,
+	)
+}
+
+// syslogHeaderField replaces what RFC 5424 does not allow in header fields
+// and uses the nil value for empty ones.
+func syslogHeaderField(value string, maxLength int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
@@ -0,0 +1,111 @@
+package firehose
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("syslogSink", func() {
+	logMessage := func(messageType events.LogMessage_MessageType, message string) *events.Envelope {
+		return &events.Envelope{
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:        []byte(message),
+				MessageType:    messageType.Enum(),
+				Timestamp:      proto.Int64(1500000000123456789),
+				AppId:          proto.String("app-guid"),
+				SourceType:     proto.String("APP/PROC/WEB"),
+				SourceInstance: proto.String("2"),
+			},
+		}
+	}
+
+	It("formats log messages as RFC 5424 messages", func() {
+		Expect(syslogMessage(logMessage(events.LogMessage_OUT, "started\n").GetLogMessage())).To(Equal(
+			"<14>1 2017-07-14T02:40:00.123456Z app-guid APP/PROC/WEB 2 - - started"))
+		Expect(syslogMessage(logMessage(events.LogMessage_ERR, "failed").GetLogMessage())).To(HavePrefix("<11>1 "))
+	})
+
+	It("uses the nil value for missing header fields", func() {
+		Expect(syslogMessage(&events.LogMessage{Message: []byte("hi"), Timestamp: proto.Int64(0)})).To(Equal(
+			"<14>1 1970-01-01T00:00:00Z - - - - - hi"))
+		Expect(syslogHeaderField("RTR has spaces", 48)).To(Equal("RTR_has_spaces"))
+	})
+
+	It("rejects unknown schemes", func() {
+		_, err := newSyslogSink("http://localhost:514", nil)
+		Expect(err).To(MatchError(ContainSubstring("Unable to parse syslog address http://localhost:514")))
+	})
+
+	It("sends a datagram per message over UDP", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		s, err := newSyslogSink("udp://"+conn.LocalAddr().String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		Expect(s.Write(&events.Envelope{EventType: events.Envelope_ValueMetric.Enum()})).To(Succeed())
+		Expect(s.Write(logMessage(events.LogMessage_OUT, "hello"))).To(Succeed())
+
+		buffer := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buffer[:n])).To(HaveSuffix("APP/PROC/WEB 2 - - hello"))
+	})
+
+	readAll := func(listener net.Listener) <-chan string {
+		received := make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			data, _ := ioutil.ReadAll(bufio.NewReader(conn))
+			received <- string(data)
+		}()
+		return received
+	}
+
+	It("frames messages by octet counting over TCP", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		received := readAll(listener)
+
+		s, err := newSyslogSink("tcp://"+listener.Addr().String(), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Write(logMessage(events.LogMessage_OUT, "one"))).To(Succeed())
+		Expect(s.Write(logMessage(events.LogMessage_OUT, "two"))).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+
+		Eventually(received).Should(Receive(Equal(
+			"65 <14>1 2017-07-14T02:40:00.123456Z app-guid APP/PROC/WEB 2 - - one" +
+				"65 <14>1 2017-07-14T02:40:00.123456Z app-guid APP/PROC/WEB 2 - - two")))
+	})
+
+	It("connects over TLS", func() {
+		server := httptest.NewTLSServer(nil)
+		defer server.Close()
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		received := readAll(listener)
+
+		s, err := newSyslogSink("tcp+tls://"+listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.Write(logMessage(events.LogMessage_ERR, "secure"))).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+
+		Eventually(received).Should(Receive(HavePrefix("68 <11>1 ")))
+	})
+})
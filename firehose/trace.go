@@ -0,0 +1,63 @@
+package firehose
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// tracer keeps only the envelopes correlated with a single request: the
+// HTTP events carrying its ID and the log messages mentioning it, such as
+// the gorouter access log with its x-vcap-request-id.
+type tracer struct {
+	requestID string
+}
+
+func newTracer(requestID string) (*tracer, error) {
+	requestID = strings.ToLower(strings.TrimSpace(requestID))
+	if requestID != "" && !requestIDPattern.MatchString(requestID) {
+		return nil, fmt.Errorf("Unable to parse request ID %s. Use a UUID such as 6ba7b810-9dad-11d1-80b4-00c04fd430c8", requestID)
+	}
+	return &tracer{requestID: requestID}, nil
+}
+
+func (t *tracer) enabled() bool {
+	return t.requestID != ""
+}
+
+func (t *tracer) traced(envelope *events.Envelope) bool {
+	if !t.enabled() {
+		return true
+	}
+	switch envelope.GetEventType() {
+	case events.Envelope_HttpStart:
+		start := envelope.GetHttpStart()
+		return t.matches(start.GetRequestId()) || t.matches(start.GetParentRequestId())
+	case events.Envelope_HttpStop:
+		return t.matches(envelope.GetHttpStop().GetRequestId())
+	case events.Envelope_HttpStartStop:
+		return t.matches(envelope.GetHttpStartStop().GetRequestId())
+	case events.Envelope_LogMessage:
+		message := strings.ToLower(string(envelope.GetLogMessage().GetMessage()))
+		return strings.Contains(message, t.requestID)
+	}
+	return false
+}
+
+func (t *tracer) matches(id *events.UUID) bool {
+	return id != nil && uuidString(id) == t.requestID
+}
+
+// uuidString formats a UUID in its canonical form. The Low and High halves
+// hold the first and last eight bytes of the UUID in little endian order.
+func uuidString(id *events.UUID) string {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], id.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], id.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,69 @@
+package firehose
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tracer", func() {
+	const requestID = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	id := &events.UUID{Low: proto.Uint64(0xd111ad9d10b8a76b), High: proto.Uint64(0xc830d44fc000b480)}
+	other := &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)}
+
+	It("formats UUIDs in their canonical form", func() {
+		Expect(uuidString(id)).To(Equal(requestID))
+		Expect(uuidString(other)).To(Equal("01000000-0000-0000-0200-000000000000"))
+	})
+
+	It("rejects request IDs that are not UUIDs", func() {
+		_, err := newTracer("not-a-uuid")
+		Expect(err).To(MatchError(ContainSubstring("Unable to parse request ID not-a-uuid")))
+	})
+
+	It("lets everything through when disabled", func() {
+		t, err := newTracer("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.traced(&events.Envelope{EventType: events.Envelope_ValueMetric.Enum()})).To(BeTrue())
+	})
+
+	Describe("with a request ID", func() {
+		var t *tracer
+		BeforeEach(func() {
+			var err error
+			t, err = newTracer("6BA7B810-9DAD-11D1-80B4-00C04FD430C8")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("matches the request ID of HTTP events", func() {
+			Expect(t.traced(&events.Envelope{
+				EventType:     events.Envelope_HttpStartStop.Enum(),
+				HttpStartStop: &events.HttpStartStop{RequestId: id},
+			})).To(BeTrue())
+			Expect(t.traced(&events.Envelope{
+				EventType: events.Envelope_HttpStop.Enum(),
+				HttpStop:  &events.HttpStop{RequestId: other},
+			})).To(BeFalse())
+			Expect(t.traced(&events.Envelope{
+				EventType: events.Envelope_HttpStart.Enum(),
+				HttpStart: &events.HttpStart{RequestId: other, ParentRequestId: id},
+			})).To(BeTrue())
+		})
+
+		It("matches log messages mentioning the request ID", func() {
+			Expect(t.traced(&events.Envelope{
+				EventType:  events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{Message: []byte(`example.com - "GET / HTTP/1.1" 200 x_vcap_request_id:"` + requestID + `"`)},
+			})).To(BeTrue())
+			Expect(t.traced(&events.Envelope{
+				EventType:  events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{Message: []byte("unrelated")},
+			})).To(BeFalse())
+		})
+
+		It("drops other event types", func() {
+			Expect(t.traced(&events.Envelope{EventType: events.Envelope_ValueMetric.Enum()})).To(BeFalse())
+		})
+	})
+})
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry/cli/cf/terminal"
 	"github.com/cloudfoundry/cli/cf/trace"
@@ -34,10 +38,43 @@ func (c *NozzlerCmd) GetMetadata() plugin.PluginMetadata {
 				UsageDetails: plugin.Usage{
 					Usage: "cf nozzle",
 					Options: map[string]string{
-						"debug":           "-d, enable debugging",
-						"no-filter":       "-n, no firehose filter. Display all messages",
-						"filter":          "-f, specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop",
-						"subscription-id": "-s, specify subscription id for distributing firehose output between clients",
+						"debug":                "-d, enable debugging",
+						"no-filter":            "-n, no firehose filter. Display all messages",
+						"filter":               "-f, specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop",
+						"subscription-id":      "-s, specify subscription id for distributing firehose output between clients",
+						"duration":             "stop after the given duration such as 30s or 5m",
+						"count":                "stop after displaying the given number of messages",
+						"until":                "stop after displaying a message matching the given pattern",
+						"connections":          "open the given number of connections with the same subscription id",
+						"buffer-size":          "number of messages to buffer between the connection and the output, defaults to 1000",
+						"buffer-policy":        "what to do when the buffer is full: block, drop-oldest, drop-newest or sample",
+						"sample":               "display a uniform sample of the messages such as 1/100",
+						"sample-per-key":       "display a sample of the messages every second for each combination of the given fields such as origin,job",
+						"sample-reservoir":     "number of messages sampled per key every second, defaults to 1",
+						"max-rate":             "display at most the given number of messages per second such as 100/s",
+						"dedupe":               "collapse identical log messages and errors within the given window such as 10s",
+						"dedupe-normalize":     "ignore numbers when comparing messages for --dedupe",
+						"trace":                "only display messages correlated with the given request id",
+						"prometheus":           "serve the received metrics for Prometheus on the given address such as :9191 instead of displaying them",
+						"output":               "write metrics in the given format, influx or graphite, instead of displaying the messages",
+						"output-address":       "send the --output metrics to a tcp:// or udp:// address instead of stdout",
+						"statsd":               "send counters, gauges and HTTP timers to statsd at the given UDP address such as localhost:8125 instead of displaying the messages",
+						"statsd-template":      "statsd metric name built from {origin}, {deployment}, {job}, {index} and {name}, defaults to {origin}.{name}",
+						"statsd-sanitize":      "pattern of the characters replaced by _ in statsd metric names, defaults to [^a-zA-Z0-9_.-]",
+						"syslog":               "forward log messages to syslog at a udp://, tcp:// or tcp+tls:// address instead of displaying them",
+						"serve-sse":            "stream the messages as JSON server-sent events on the given address such as :8080, filtered per connection by the type, origin and app query parameters",
+						"output-file":          "also write the messages to the given file, rotating and compressing it",
+						"output-file-max-size": "rotate the --output-file once it reaches the given size such as 100MB, defaults to 100MB",
+						"output-file-rotate":   "rotate the --output-file after the given time such as 24h",
+						"output-file-keep":     "number of rotated --output-file files to keep, defaults to 10",
+						"store":                storeUsage("also write the messages to the given SQLite database, to query with cf nozzle-query"),
+						"ring":                 "keep the given number of the last messages received, before filtering, to dump into a file on SIGUSR1",
+						"ring-trigger":         "also dump the --ring messages when displaying a message matching the given pattern",
+						"ring-dir":             "directory to dump the --ring messages into, defaults to the current directory",
+						"profile":              "read options from the given profile of ~/.cf/nozzle.yml, overridden by the ones given on the command line",
+						"non-interactive":      "never prompt, which is the default when stdin is not a terminal",
+						"default-filter":       "message filter to use instead of prompting in non-interactive mode, such as LogMessage or all",
+						"stitch":               "join HttpStart and HttpStop events into one record per request, waiting up to the given time such as 30s for both halves",
 					},
 				},
 			},
@@ -47,31 +84,122 @@ func (c *NozzlerCmd) GetMetadata() plugin.PluginMetadata {
 				UsageDetails: plugin.Usage{
 					Usage: "cf app-nozzle APP_NAME",
 					Options: map[string]string{
-						"debug":     "-d, enable debugging",
-						"no-filter": "-n, no filter. Display all messages",
-						"filter":    "-f, specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop",
+						"debug":                "-d, enable debugging",
+						"no-filter":            "-n, no filter. Display all messages",
+						"filter":               "-f, specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop",
+						"duration":             "stop after the given duration such as 30s or 5m",
+						"count":                "stop after displaying the given number of messages",
+						"until":                "stop after displaying a message matching the given pattern",
+						"buffer-size":          "number of messages to buffer between the connection and the output, defaults to 1000",
+						"buffer-policy":        "what to do when the buffer is full: block, drop-oldest, drop-newest or sample",
+						"sample":               "display a uniform sample of the messages such as 1/100",
+						"sample-per-key":       "display a sample of the messages every second for each combination of the given fields such as origin,job",
+						"sample-reservoir":     "number of messages sampled per key every second, defaults to 1",
+						"max-rate":             "display at most the given number of messages per second such as 100/s",
+						"dedupe":               "collapse identical log messages and errors within the given window such as 10s",
+						"dedupe-normalize":     "ignore numbers when comparing messages for --dedupe",
+						"trace":                "only display messages correlated with the given request id",
+						"prometheus":           "serve the received metrics for Prometheus on the given address such as :9191 instead of displaying them",
+						"output":               "write metrics in the given format, influx or graphite, instead of displaying the messages",
+						"output-address":       "send the --output metrics to a tcp:// or udp:// address instead of stdout",
+						"statsd":               "send counters, gauges and HTTP timers to statsd at the given UDP address such as localhost:8125 instead of displaying the messages",
+						"statsd-template":      "statsd metric name built from {origin}, {deployment}, {job}, {index} and {name}, defaults to {origin}.{name}",
+						"statsd-sanitize":      "pattern of the characters replaced by _ in statsd metric names, defaults to [^a-zA-Z0-9_.-]",
+						"syslog":               "forward log messages to syslog at a udp://, tcp:// or tcp+tls:// address instead of displaying them",
+						"serve-sse":            "stream the messages as JSON server-sent events on the given address such as :8080, filtered per connection by the type, origin and app query parameters",
+						"output-file":          "also write the messages to the given file, rotating and compressing it",
+						"output-file-max-size": "rotate the --output-file once it reaches the given size such as 100MB, defaults to 100MB",
+						"output-file-rotate":   "rotate the --output-file after the given time such as 24h",
+						"output-file-keep":     "number of rotated --output-file files to keep, defaults to 10",
+						"store":                storeUsage("also write the messages to the given SQLite database, to query with cf nozzle-query"),
+						"ring":                 "keep the given number of the last messages received, before filtering, to dump into a file on SIGUSR1",
+						"ring-trigger":         "also dump the --ring messages when displaying a message matching the given pattern",
+						"ring-dir":             "directory to dump the --ring messages into, defaults to the current directory",
+						"profile":              "read options from the given profile of ~/.cf/nozzle.yml, overridden by the ones given on the command line",
+						"non-interactive":      "never prompt, which is the default when stdin is not a terminal",
+						"default-filter":       "message filter to use instead of prompting in non-interactive mode, such as LogMessage or all",
+						"stitch":               "join HttpStart and HttpStop events into one record per request, waiting up to the given time such as 30s for both halves",
+					},
+				},
+			},
+			{
+				Name:     "nozzle-trace",
+				HelpText: "Displays messages from the firehose correlated with a given request",
+				UsageDetails: plugin.Usage{
+					Usage: "cf nozzle-trace REQUEST_ID",
+					Options: map[string]string{
+						"debug":           "-d, enable debugging",
+						"filter":          "-f, specify message filter such as LogMessage, HttpStartStop",
+						"subscription-id": "-s, specify subscription id for distributing firehose output between clients",
+						"duration":        "stop after the given duration such as 30s or 5m",
+						"count":           "stop after displaying the given number of messages",
 					},
 				},
 			},
+			{
+				Name:     "nozzle-proxy",
+				HelpText: "Re-serves one firehose connection to local websocket clients",
+				UsageDetails: plugin.Usage{
+					Usage: "cf nozzle-proxy",
+					Options: map[string]string{
+						"debug":           "-d, enable debugging",
+						"filter":          "-f, specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop",
+						"subscription-id": "-s, specify subscription id for distributing firehose output between clients",
+						"listen":          "address to accept websocket clients on, defaults to 127.0.0.1:8081",
+					},
+				},
+			},
+			{
+				Name:     "nozzle-patterns",
+				HelpText: "Groups log messages from the firehose into patterns and reports the most frequent ones",
+				UsageDetails: plugin.Usage{
+					Usage: "cf nozzle-patterns",
+					Options: map[string]string{
+						"debug":           "-d, enable debugging",
+						"subscription-id": "-s, specify subscription id for distributing firehose output between clients",
+						"duration":        "how long to collect log messages for, defaults to 1m",
+						"top":             "number of patterns to report, defaults to 10",
+					},
+				},
+			},
+			{
+				Name:     "nozzle-query",
+				HelpText: storeUsage("Queries messages stored with cf nozzle --store"),
+				UsageDetails: plugin.Usage{
+					Usage: "cf nozzle-query DATABASE SQL",
+				},
+			},
 		},
 	}
 }
 
+// storeUsage tells users of builds made without cgo, such as the Linux and
+// Windows release binaries, that they cannot use the SQLite store.
+func storeUsage(usage string) string {
+	if firehose.StoreSupported {
+		return usage
+	}
+	return usage + " (unavailable in this build, which was made without cgo)"
+}
+
 func main() {
 	plugin.Start(new(NozzlerCmd))
 }
 
 func (c *NozzlerCmd) Run(cliConnection plugin.CliConnection, args []string) {
 	var options *firehose.ClientOptions
+	var patterns *firehose.PatternCollector
+	var proxy *firehose.Proxy
+	var top int
 
 	traceLogger := trace.NewLogger(os.Stdout, true, os.Getenv("CF_TRACE"), "")
 	c.ui = terminal.NewUI(os.Stdin, os.Stdout, terminal.NewTeePrinter(os.Stdout), traceLogger)
 
 	switch args[0] {
 	case "nozzle":
-		options = c.buildClientOptions(args)
+		options, _ = c.buildClientOptions(args)
 	case "app-nozzle":
-		options = c.buildClientOptions(args)
+		options, _ = c.buildClientOptions(args)
 		appModel, err := cliConnection.GetApp(args[1])
 		if err != nil {
 			c.ui.Warn(err.Error())
@@ -79,9 +207,42 @@ func (c *NozzlerCmd) Run(cliConnection plugin.CliConnection, args []string) {
 		}
 
 		options.AppGUID = appModel.Guid
+	case "nozzle-trace":
+		var positional []string
+		options, positional = c.buildClientOptions(args)
+		if len(positional) < 1 {
+			c.ui.Failed("Missing request ID. Usage: cf nozzle-trace REQUEST_ID")
+		}
+		options.Trace = positional[0]
+		options.NoFilter = options.Filter == ""
+	case "nozzle-proxy":
+		var listen string
+		options, listen = c.buildProxyOptions(args)
+		var err error
+		proxy, err = firehose.NewProxy(listen)
+		if err != nil {
+			c.ui.Failed(err.Error())
+		}
+		defer proxy.Close()
+		c.ui.Say("Proxying the firehose on ws://%s/firehose/SUBSCRIPTION_ID and ws://%s/apps/APP_GUID/stream", proxy.Address(), proxy.Address())
+	case "nozzle-patterns":
+		options, top = c.buildPatternsOptions(args)
+		patterns = firehose.NewPatternCollector()
+	case "nozzle-query":
+		c.query(args)
+		return
 	default:
 		return
 	}
+	if options.WritesMetricsToStdout() {
+		// Leave stdout to the metric lines, so that they can be piped.
+		traceLogger = trace.NewLogger(os.Stderr, true, os.Getenv("CF_TRACE"), "")
+		c.ui = terminal.NewUI(os.Stdin, os.Stderr, terminal.NewTeePrinter(os.Stderr), traceLogger)
+	}
+
+	if options.NonInteractive && options.PromptsForFilter() && options.DefaultFilter == "" {
+		c.ui.Failed(firehose.ErrNonInteractive.Error())
+	}
 
 	dopplerEndpoint, err := cliConnection.DopplerEndpoint()
 	if err != nil {
@@ -94,20 +255,391 @@ func (c *NozzlerCmd) Run(cliConnection plugin.CliConnection, args []string) {
 	}
 
 	client := firehose.NewClient(authToken, dopplerEndpoint, options, c.ui)
-	client.Start()
+	if patterns != nil {
+		client.AddSink(patterns)
+	}
+	if proxy != nil {
+		client.AddSink(proxy)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		for range signals {
+			if !client.Interrupt() {
+				os.Exit(130)
+			}
+		}
+	}()
+
+	if len(dumpSignals) > 0 {
+		dumps := make(chan os.Signal, 1)
+		signal.Notify(dumps, dumpSignals...)
+		defer func() {
+			signal.Stop(dumps)
+			close(dumps)
+		}()
+		go func() {
+			for range dumps {
+				client.DumpRing()
+			}
+		}()
+	}
+
+	err = client.Start(context.Background())
+
+	if patterns != nil {
+		patterns.Print(c.ui, top)
+		return
+	}
+	if proxy != nil && proxy.Dropped() > 0 {
+		c.ui.Warn("Dropped %d messages for proxy clients that fell behind", proxy.Dropped())
+	}
+
+	if options.HasStopCondition() && err != nil {
+		c.ui.Failed("The nozzle stopped before any stop condition was met: %s", err)
+	}
+}
+
+// stdinIsTerminal tells scripts and CI jobs, whose stdin is a pipe or a
+// file, apart from users who can answer prompts.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (c *NozzlerCmd) query(args []string) {
+	if len(args) < 3 {
+		c.ui.Failed("Missing database or query. Usage: cf nozzle-query DATABASE SQL")
+	}
+
+	columns, rows, err := firehose.QueryStore(args[1], args[2])
+	if err != nil {
+		c.ui.Failed(err.Error())
+	}
+	if len(rows) == 0 {
+		c.ui.Say("No rows found")
+		return
+	}
+
+	table := c.ui.Table(columns)
+	for _, row := range rows {
+		table.Add(row...)
+	}
+	table.Print()
 }
 
-func (c *NozzlerCmd) buildClientOptions(args []string) *firehose.ClientOptions {
+// buildClientOptions also returns the arguments left after the flags.
+func (c *NozzlerCmd) buildClientOptions(args []string) (*firehose.ClientOptions, []string) {
 	var debug bool
 	var noFilter bool
 	var filter string
 	var subscriptionId string
+	var duration time.Duration
+	var count int
+	var until string
+	var connections int
+	var bufferSize int
+	var bufferPolicy string
+	var sample string
+	var samplePerKey string
+	var sampleReservoir int
+	var maxRate string
+	var dedupe time.Duration
+	var dedupeNormalize bool
+	var trace string
+	var stitch time.Duration
+	var prometheus string
+	var noDisplay bool
+	var output string
+	var outputAddress string
+	var statsd string
+	var statsdTemplate string
+	var statsdSanitize string
+	var syslog string
+	var serveSSE string
+	var outputFile string
+	var outputFileMaxSize string
+	var outputFileRotate time.Duration
+	var outputFileKeep int
+	var store string
+	var ring int
+	var ringTrigger string
+	var ringDir string
+	nonInteractive := !stdinIsTerminal()
+	var defaultFilter string
+
+	fc := newClientFlags()
+	err := fc.Parse(args[1:]...)
+
+	if err != nil {
+		c.ui.Failed(err.Error())
+	}
+	if fc.IsSet("profile") {
+		profile, err := loadProfile(configPath(), fc.String("profile"))
+		if err != nil {
+			c.ui.Failed(err.Error())
+		}
+		fc = profileFlags{FlagContext: fc, profile: profile}
+	}
+	if fc.IsSet("debug") {
+		debug = fc.Bool("debug")
+	}
+	if fc.IsSet("no-filter") {
+		noFilter = fc.Bool("no-filter")
+	}
+	if fc.IsSet("filter") {
+		filter = fc.String("filter")
+	}
+	if fc.IsSet("subscription-id") {
+		subscriptionId = fc.String("subscription-id")
+	}
+	if fc.IsSet("duration") {
+		duration, err = time.ParseDuration(fc.String("duration"))
+		if err != nil {
+			c.ui.Failed("Invalid duration %s: %s", fc.String("duration"), err.Error())
+		}
+		if duration <= 0 {
+			c.ui.Failed("Invalid duration %s", fc.String("duration"))
+		}
+	}
+	if fc.IsSet("count") {
+		count = fc.Int("count")
+		if count < 1 {
+			c.ui.Failed("Invalid count %d", count)
+		}
+	}
+	if fc.IsSet("until") {
+		until = fc.String("until")
+	}
+	if fc.IsSet("connections") {
+		connections = fc.Int("connections")
+		if connections < 1 {
+			c.ui.Failed("Invalid number of connections %d", connections)
+		}
+	}
+	if fc.IsSet("buffer-size") {
+		bufferSize = fc.Int("buffer-size")
+		if bufferSize < 1 {
+			c.ui.Failed("Invalid buffer size %d", bufferSize)
+		}
+	}
+	if fc.IsSet("buffer-policy") {
+		bufferPolicy = fc.String("buffer-policy")
+	}
+	if fc.IsSet("sample") {
+		sample = fc.String("sample")
+	}
+	if fc.IsSet("sample-per-key") {
+		samplePerKey = fc.String("sample-per-key")
+	}
+	if fc.IsSet("sample-reservoir") {
+		sampleReservoir = fc.Int("sample-reservoir")
+		if sampleReservoir < 1 {
+			c.ui.Failed("Invalid sample reservoir %d", sampleReservoir)
+		}
+	}
+	if fc.IsSet("max-rate") {
+		maxRate = fc.String("max-rate")
+	}
+	if fc.IsSet("dedupe") {
+		dedupe, err = time.ParseDuration(fc.String("dedupe"))
+		if err != nil || dedupe <= 0 {
+			c.ui.Failed("Invalid dedupe window %s", fc.String("dedupe"))
+		}
+	}
+	if fc.IsSet("dedupe-normalize") {
+		dedupeNormalize = fc.Bool("dedupe-normalize")
+	}
+	if fc.IsSet("trace") {
+		trace = fc.String("trace")
+	}
+	if fc.IsSet("prometheus") {
+		prometheus = fc.String("prometheus")
+	}
+	if fc.IsSet("output") {
+		output = fc.String("output")
+	}
+	if fc.IsSet("output-address") {
+		outputAddress = fc.String("output-address")
+	}
+	if fc.IsSet("statsd") {
+		statsd = fc.String("statsd")
+	}
+	if fc.IsSet("statsd-template") {
+		statsdTemplate = fc.String("statsd-template")
+	}
+	if fc.IsSet("statsd-sanitize") {
+		statsdSanitize = fc.String("statsd-sanitize")
+	}
+	if fc.IsSet("syslog") {
+		syslog = fc.String("syslog")
+	}
+	if fc.IsSet("serve-sse") {
+		serveSSE = fc.String("serve-sse")
+	}
+	if fc.IsSet("output-file") {
+		outputFile = fc.String("output-file")
+	}
+	if fc.IsSet("output-file-max-size") {
+		outputFileMaxSize = fc.String("output-file-max-size")
+	}
+	if fc.IsSet("output-file-rotate") {
+		outputFileRotate, err = time.ParseDuration(fc.String("output-file-rotate"))
+		if err != nil || outputFileRotate <= 0 {
+			c.ui.Failed("Invalid rotation interval %s", fc.String("output-file-rotate"))
+		}
+	}
+	if fc.IsSet("output-file-keep") {
+		outputFileKeep = fc.Int("output-file-keep")
+		if outputFileKeep < 1 {
+			c.ui.Failed("Invalid number of files to keep %d", outputFileKeep)
+		}
+	}
+	if fc.IsSet("store") {
+		store = fc.String("store")
+	}
+	if fc.IsSet("ring") {
+		ring = fc.Int("ring")
+		if ring < 1 {
+			c.ui.Failed("Invalid ring size %d", ring)
+		}
+	}
+	if fc.IsSet("ring-trigger") {
+		ringTrigger = fc.String("ring-trigger")
+	}
+	if fc.IsSet("ring-dir") {
+		ringDir = fc.String("ring-dir")
+	}
+	if fc.IsSet("non-interactive") && fc.Bool("non-interactive") {
+		nonInteractive = true
+	}
+	if fc.IsSet("default-filter") {
+		defaultFilter = fc.String("default-filter")
+	}
+	if prometheus != "" || output != "" || statsd != "" || serveSSE != "" {
+		// Serving the messages elsewhere replaces the display and, unless
+		// filtered, needs every event type.
+		noDisplay = true
+		if filter == "" {
+			noFilter = true
+		}
+	}
+	if syslog != "" {
+		noDisplay = true
+		if filter == "" && !noFilter {
+			filter = "LogMessage"
+		}
+	}
+	if fc.IsSet("stitch") {
+		stitch, err = time.ParseDuration(fc.String("stitch"))
+		if err != nil || stitch <= 0 {
+			c.ui.Failed("Invalid stitch timeout %s", fc.String("stitch"))
+		}
+	}
+
+	return &firehose.ClientOptions{
+		Debug:             debug,
+		NoFilter:          noFilter,
+		Filter:            filter,
+		SubscriptionID:    subscriptionId,
+		Duration:          duration,
+		Count:             count,
+		Until:             until,
+		Connections:       connections,
+		BufferSize:        bufferSize,
+		BufferPolicy:      bufferPolicy,
+		Sample:            sample,
+		SamplePerKey:      samplePerKey,
+		SampleReservoir:   sampleReservoir,
+		MaxRate:           maxRate,
+		Dedupe:            dedupe,
+		DedupeNormalize:   dedupeNormalize,
+		Trace:             trace,
+		Stitch:            stitch,
+		Prometheus:        prometheus,
+		Output:            output,
+		OutputAddress:     outputAddress,
+		Statsd:            statsd,
+		StatsdTemplate:    statsdTemplate,
+		StatsdSanitize:    statsdSanitize,
+		Syslog:            syslog,
+		ServeSSE:          serveSSE,
+		OutputFile:        outputFile,
+		OutputFileMaxSize: outputFileMaxSize,
+		OutputFileRotate:  outputFileRotate,
+		OutputFileKeep:    outputFileKeep,
+		Store:             store,
+		Ring:              ring,
+		RingTrigger:       ringTrigger,
+		RingDir:           ringDir,
+		NonInteractive:    nonInteractive,
+		DefaultFilter:     defaultFilter,
+		SelectionFile:     selectionPath(),
+		SelectionKey:      args[0],
+		NoDisplay:         noDisplay,
+	}, fc.Args()
+}
 
+// newClientFlags defines the flags of the nozzle commands, which profiles
+// can set as well.
+func newClientFlags() flags.FlagContext {
 	fc := flags.New()
 	fc.NewBoolFlag("debug", "d", "used for debugging")
 	fc.NewBoolFlag("no-filter", "n", "no firehose filter. Display all messages")
 	fc.NewStringFlag("filter", "f", "specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop")
 	fc.NewStringFlag("subscription-id", "s", "specify subscription id for distributing firehose output between clients")
+	fc.NewStringFlag("duration", "", "stop after the given duration such as 30s or 5m")
+	fc.NewIntFlag("count", "", "stop after displaying the given number of messages")
+	fc.NewStringFlag("until", "", "stop after displaying a message matching the given pattern")
+	fc.NewIntFlag("connections", "", "open the given number of connections with the same subscription id")
+	fc.NewIntFlag("buffer-size", "", "number of messages to buffer between the connection and the output, defaults to 1000")
+	fc.NewStringFlag("buffer-policy", "", "what to do when the buffer is full: block, drop-oldest, drop-newest or sample")
+	fc.NewStringFlag("sample", "", "display a uniform sample of the messages such as 1/100")
+	fc.NewStringFlag("sample-per-key", "", "display a sample of the messages every second for each combination of the given fields such as origin,job")
+	fc.NewIntFlag("sample-reservoir", "", "number of messages sampled per key every second, defaults to 1")
+	fc.NewStringFlag("max-rate", "", "display at most the given number of messages per second such as 100/s")
+	fc.NewStringFlag("dedupe", "", "collapse identical log messages and errors within the given window such as 10s")
+	fc.NewBoolFlag("dedupe-normalize", "", "ignore numbers when comparing messages for --dedupe")
+	fc.NewStringFlag("trace", "", "only display messages correlated with the given request id")
+	fc.NewStringFlag("prometheus", "", "serve the received metrics for Prometheus on the given address such as :9191 instead of displaying them")
+	fc.NewStringFlag("output", "", "write metrics in the given format, influx or graphite, instead of displaying the messages")
+	fc.NewStringFlag("output-address", "", "send the --output metrics to a tcp:// or udp:// address instead of stdout")
+	fc.NewStringFlag("statsd", "", "send counters, gauges and HTTP timers to statsd at the given UDP address such as localhost:8125 instead of displaying the messages")
+	fc.NewStringFlag("statsd-template", "", "statsd metric name built from {origin}, {deployment}, {job}, {index} and {name}, defaults to {origin}.{name}")
+	fc.NewStringFlag("statsd-sanitize", "", "pattern of the characters replaced by _ in statsd metric names, defaults to [^a-zA-Z0-9_.-]")
+	fc.NewStringFlag("syslog", "", "forward log messages to syslog at a udp://, tcp:// or tcp+tls:// address instead of displaying them")
+	fc.NewStringFlag("serve-sse", "", "stream the messages as JSON server-sent events on the given address such as :8080, filtered per connection by the type, origin and app query parameters")
+	fc.NewStringFlag("output-file", "", "also write the messages to the given file, rotating and compressing it")
+	fc.NewStringFlag("output-file-max-size", "", "rotate the --output-file once it reaches the given size such as 100MB, defaults to 100MB")
+	fc.NewStringFlag("output-file-rotate", "", "rotate the --output-file after the given time such as 24h")
+	fc.NewIntFlag("output-file-keep", "", "number of rotated --output-file files to keep, defaults to 10")
+	fc.NewStringFlag("store", "", storeUsage("also write the messages to the given SQLite database, to query with cf nozzle-query"))
+	fc.NewIntFlag("ring", "", "keep the given number of the last messages received, before filtering, to dump into a file on SIGUSR1")
+	fc.NewStringFlag("ring-trigger", "", "also dump the --ring messages when displaying a message matching the given pattern")
+	fc.NewStringFlag("ring-dir", "", "directory to dump the --ring messages into, defaults to the current directory")
+	fc.NewStringFlag("stitch", "", "join HttpStart and HttpStop events into one record per request, waiting up to the given time such as 30s for both halves")
+	fc.NewStringFlag("profile", "", "read options from the given profile of ~/.cf/nozzle.yml, overridden by the ones given on the command line")
+	fc.NewBoolFlag("non-interactive", "", "never prompt, which is the default when stdin is not a terminal")
+	fc.NewStringFlag("default-filter", "", "message filter to use instead of prompting in non-interactive mode, such as LogMessage or all")
+	return fc
+}
+
+func (c *NozzlerCmd) buildPatternsOptions(args []string) (*firehose.ClientOptions, int) {
+	var debug bool
+	var subscriptionId string
+	duration := time.Minute
+	top := 10
+
+	fc := flags.New()
+	fc.NewBoolFlag("debug", "d", "used for debugging")
+	fc.NewStringFlag("subscription-id", "s", "specify subscription id for distributing firehose output between clients")
+	fc.NewStringFlag("duration", "", "how long to collect log messages for, defaults to 1m")
+	fc.NewIntFlag("top", "", "number of patterns to report, defaults to 10")
 	err := fc.Parse(args[1:]...)
 
 	if err != nil {
@@ -116,8 +648,49 @@ func (c *NozzlerCmd) buildClientOptions(args []string) *firehose.ClientOptions {
 	if fc.IsSet("debug") {
 		debug = fc.Bool("debug")
 	}
-	if fc.IsSet("no-filter") {
-		noFilter = fc.Bool("no-filter")
+	if fc.IsSet("subscription-id") {
+		subscriptionId = fc.String("subscription-id")
+	}
+	if fc.IsSet("duration") {
+		duration, err = time.ParseDuration(fc.String("duration"))
+		if err != nil || duration <= 0 {
+			c.ui.Failed("Invalid duration %s", fc.String("duration"))
+		}
+	}
+	if fc.IsSet("top") {
+		top = fc.Int("top")
+		if top < 1 {
+			c.ui.Failed("Invalid number of patterns %d", top)
+		}
+	}
+
+	return &firehose.ClientOptions{
+		Debug:          debug,
+		Filter:         "LogMessage",
+		SubscriptionID: subscriptionId,
+		Duration:       duration,
+		NoDisplay:      true,
+	}, top
+}
+
+func (c *NozzlerCmd) buildProxyOptions(args []string) (*firehose.ClientOptions, string) {
+	var debug bool
+	var filter string
+	var subscriptionId string
+	listen := "127.0.0.1:8081"
+
+	fc := flags.New()
+	fc.NewBoolFlag("debug", "d", "used for debugging")
+	fc.NewStringFlag("filter", "f", "specify message filter such as LogMessage, ValueMetric, CounterEvent, HttpStartStop")
+	fc.NewStringFlag("subscription-id", "s", "specify subscription id for distributing firehose output between clients")
+	fc.NewStringFlag("listen", "", "address to accept websocket clients on, defaults to 127.0.0.1:8081")
+	err := fc.Parse(args[1:]...)
+
+	if err != nil {
+		c.ui.Failed(err.Error())
+	}
+	if fc.IsSet("debug") {
+		debug = fc.Bool("debug")
 	}
 	if fc.IsSet("filter") {
 		filter = fc.String("filter")
@@ -125,11 +698,15 @@ func (c *NozzlerCmd) buildClientOptions(args []string) *firehose.ClientOptions {
 	if fc.IsSet("subscription-id") {
 		subscriptionId = fc.String("subscription-id")
 	}
+	if fc.IsSet("listen") {
+		listen = fc.String("listen")
+	}
 
 	return &firehose.ClientOptions{
 		Debug:          debug,
-		NoFilter:       noFilter,
+		NoFilter:       filter == "",
 		Filter:         filter,
 		SubscriptionID: subscriptionId,
-	}
+		NoDisplay:      true,
+	}, listen
 }
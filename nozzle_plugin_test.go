@@ -2,12 +2,16 @@ package main_test
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cloudfoundry/cli/plugin/models"
 	"github.com/cloudfoundry/cli/plugin/pluginfakes"
 	io_helpers "github.com/cloudfoundry/cli/testhelpers/io"
 	. "github.com/cloudfoundry/firehose-plugin"
+	"github.com/cloudfoundry/firehose-plugin/firehose"
 	"github.com/cloudfoundry/firehose-plugin/testhelpers"
 
 	"github.com/cloudfoundry/sonde-go/events"
@@ -168,6 +172,78 @@ var _ = Describe("NozzlePlugin", func() {
 
 			}, 3)
 
+			It("uses the default filter in non-interactive mode", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--non-interactive", "--default-filter", "LogMessage"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+				Expect(outputString).To(ContainSubstring("logMessage:<message:\"Log Message\""))
+			}, 3)
+
+			It("leaves stdout to the metric lines when writing them there", func(done Done) {
+				defer close(done)
+				fakeFirehose.SendEvent(events.Envelope_ValueMetric, "valuemetric")
+				stderr, err := ioutil.TempFile("", "nozzle-stderr")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.Remove(stderr.Name())
+				defer stderr.Close()
+				oldStderr := os.Stderr
+				os.Stderr = stderr
+				defer func() { os.Stderr = oldStderr }()
+
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--filter", "ValueMetric", "--output", "influx"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				var lines []string
+				for _, line := range output {
+					if line != "" {
+						lines = append(lines, line)
+					}
+				}
+				Expect(lines).To(HaveLen(1))
+				Expect(lines[0]).To(MatchRegexp(`^valuemetric,\S+ value=42 1000000000$`))
+
+				messages, err := ioutil.ReadFile(stderr.Name())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(messages)).To(ContainSubstring("Starting the nozzle"))
+				Expect(string(messages)).To(ContainSubstring("Session summary:"))
+			}, 3)
+
+			It("stops once a stop condition is met", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--no-filter", "--count", "1"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).To(ContainSubstring("logMessage:<message:\"Log Message\""))
+				Expect(outputString).To(ContainSubstring("Stopping the nozzle: reached count of 1"))
+			}, 3)
+
 			Context("short flag names", func() {
 				It("displays debug info", func(done Done) {
 					defer close(done)
@@ -225,6 +301,189 @@ var _ = Describe("NozzlePlugin", func() {
 				})
 			})
 		})
+		Context("when invoked with a profile", func() {
+			var home string
+
+			BeforeEach(func() {
+				var err error
+				home, err = ioutil.TempDir("", "nozzle-home")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(os.Mkdir(filepath.Join(home, ".cf"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(home, ".cf", "nozzle.yml"), []byte(`
+profiles:
+  values:
+    filter: ValueMetric
+    count: 1
+  everything:
+    no-filter: true
+`), 0644)).To(Succeed())
+				os.Setenv("CF_HOME", home)
+			})
+
+			AfterEach(func() {
+				os.Unsetenv("CF_HOME")
+				os.RemoveAll(home)
+			})
+
+			It("uses the options of the profile, overridden by the flags", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--profile", "values", "--filter", "LogMessage"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+				Expect(outputString).To(ContainSubstring("logMessage:<message:\"Log Message\""))
+				Expect(outputString).To(ContainSubstring("Stopping the nozzle: reached count of 1"))
+			}, 3)
+
+			It("lets a filter flag override no-filter in the profile", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--profile", "everything", "--filter", "ValueMetric"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).To(ContainSubstring("LogMessage: 1 received, 0 displayed"))
+				Expect(outputString).ToNot(ContainSubstring("logMessage:<message:\"Log Message\""))
+			}, 3)
+		})
+
+		Context("when invoked via 'nozzle-trace'", func() {
+			It("only displays messages mentioning the request", func(done Done) {
+				defer close(done)
+				fakeFirehose.SendEvent(events.Envelope_LogMessage, "x_vcap_request_id:6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle-trace", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+				Expect(outputString).To(ContainSubstring("Tracing request 6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+				Expect(outputString).To(ContainSubstring("x_vcap_request_id:6ba7b810"))
+				Expect(outputString).ToNot(ContainSubstring("logMessage:<message:\"Log Message\""))
+			}, 3)
+
+			It("reads the request ID after the flags", func(done Done) {
+				defer close(done)
+				fakeFirehose.SendEvent(events.Envelope_LogMessage, "x_vcap_request_id:6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle-trace", "--buffer-size", "10", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).To(ContainSubstring("Tracing request 6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+				Expect(outputString).To(ContainSubstring("x_vcap_request_id:6ba7b810"))
+			}, 3)
+		})
+		Context("when invoked via 'nozzle-proxy'", func() {
+			It("proxies the firehose without displaying it", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle-proxy", "--listen", "127.0.0.1:0"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+				Expect(outputString).To(ContainSubstring("Proxying the firehose on ws://127.0.0.1:"))
+				Expect(outputString).ToNot(ContainSubstring("logMessage:<"))
+			}, 3)
+		})
+		Context("when invoked via 'nozzle-patterns'", func() {
+			It("reports the log patterns seen", func(done Done) {
+				defer close(done)
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle-patterns", "--duration", "1s"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).ToNot(ContainSubstring("What type of firehose messages do you want to see?"))
+				Expect(outputString).ToNot(ContainSubstring("logMessage:<"))
+				Expect(outputString).To(ContainSubstring("Top 1 of 1 log patterns from 1 messages:"))
+				Expect(outputString).To(ContainSubstring("example: Log Message"))
+			}, 3)
+		})
+
+		Context("when invoked via 'nozzle-query'", func() {
+			var dir string
+
+			BeforeEach(func() {
+				if !firehose.StoreSupported {
+					Skip("stores need a build with cgo")
+				}
+				var err error
+				dir, err = ioutil.TempDir("", "nozzle-query")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("queries the messages stored by 'nozzle --store'", func(done Done) {
+				defer close(done)
+				store := filepath.Join(dir, "capture.db")
+				outputChan := make(chan []string)
+				go func() {
+					output := io_helpers.CaptureOutput(func() {
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle", "--no-filter", "--store", store})
+						nozzlerCmd.Run(fakeCliConnection, []string{"nozzle-query", store, "SELECT origin, message FROM envelopes JOIN log_messages ON id = envelope_id"})
+					})
+					outputChan <- output
+				}()
+
+				var output []string
+				Eventually(outputChan, 2).Should(Receive(&output))
+				outputString := strings.Join(output, "|")
+
+				Expect(outputString).To(ContainSubstring("Storing messages in " + store))
+				Expect(outputString).To(ContainSubstring("logMessage:<message:\"Log Message\""))
+				Expect(outputString).To(MatchRegexp(`origin\s+message`))
+				Expect(outputString).To(MatchRegexp(`origin\s+Log Message`))
+			}, 3)
+		})
 	})
 
 })
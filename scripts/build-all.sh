@@ -25,17 +25,29 @@ LINUX_FILENAME="nozzle-plugin-linux"
 MAC_FILENAME="nozzle-plugin-darwin"
 WIN_FILENAME="nozzle-plugin.exe"
 
-GOOS=linux GOARCH=amd64 go build -o $LINUX_FILENAME
+# --store and nozzle-query need cgo for SQLite, which only the native build
+# of this macOS script has. The cross-compiled binaries leave them out, and
+# say so in their usage, unless LINUX_CC and WINDOWS_CC name C cross
+# compilers such as x86_64-linux-musl-gcc and x86_64-w64-mingw32-gcc.
+if [ -n "$LINUX_CC" ] ; then
+	GOOS=linux GOARCH=amd64 CGO_ENABLED=1 CC="$LINUX_CC" go build -ldflags '-extldflags "-static"' -o $LINUX_FILENAME
+else
+	GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o $LINUX_FILENAME
+fi
 LINUX64_SHA1=`cat $LINUX_FILENAME | openssl sha1`
 mkdir -p bin/linux64
 mv $LINUX_FILENAME bin/linux64
 
-GOOS=darwin GOARCH=amd64 go build -o $MAC_FILENAME
+GOOS=darwin GOARCH=amd64 CGO_ENABLED=1 go build -o $MAC_FILENAME
 OSX_SHA1=`cat $MAC_FILENAME | openssl sha1`
 mkdir -p bin/osx
 mv $MAC_FILENAME bin/osx
 
-GOOS=windows GOARCH=amd64 go build -o $WIN_FILENAME
+if [ -n "$WINDOWS_CC" ] ; then
+	GOOS=windows GOARCH=amd64 CGO_ENABLED=1 CC="$WINDOWS_CC" go build -o $WIN_FILENAME
+else
+	GOOS=windows GOARCH=amd64 CGO_ENABLED=0 go build -o $WIN_FILENAME
+fi
 WIN64_SHA1=`cat $WIN_FILENAME | openssl sha1`
 mkdir -p bin/win64
 mv $WIN_FILENAME bin/win64
@@ -28,6 +28,7 @@ type FakeFirehose struct {
 
 	lastAuthorization string
 	requested         bool
+	connections       int
 
 	events         []events.Envelope
 	closeMessage   []byte
@@ -77,6 +78,12 @@ func (f *FakeFirehose) Requested() bool {
 	return f.requested
 }
 
+func (f *FakeFirehose) Connections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
 func (f *FakeFirehose) SendEvent(eventType events.Envelope_EventType, message string) {
 	envelope := events.Envelope{
 		Origin:     proto.String("origin"),
@@ -167,6 +174,12 @@ func (f *FakeFirehose) SendEvent(eventType events.Envelope_EventType, message st
 	f.addEvent(envelope)
 }
 
+// SendEnvelope queues an envelope as is, for tests that need control over
+// fields SendEvent fills in on its own.
+func (f *FakeFirehose) SendEnvelope(envelope events.Envelope) {
+	f.addEvent(envelope)
+}
+
 func (f *FakeFirehose) addEvent(event events.Envelope) {
 	f.lock.Lock()
 	defer f.lock.Unlock()
@@ -205,6 +218,7 @@ func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	f.lastAuthorization = r.Header.Get("Authorization")
 	f.requested = true
+	f.connections++
 	f.subscriptionID = strings.Split(r.URL.String(), "/")[2]
 	if f.lastAuthorization != f.validToken {
 		log.Printf("Bad token passed to firehose: %s", f.lastAuthorization)